@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Which users may proxy which repositories. ACL files have one entry per
+// line:
+//
+//	# Comments and blank lines are ignored
+//	group <name> <user>...
+//	allow <user|@group|*> <pattern>...
+//
+// Patterns are matched against repository paths like "github.com/user/repo";
+// "*" matches within a path segment and "..." across segments, ex.
+// "github.com/acme/...". Anything not allowed is denied.
+type ACL struct {
+	groups map[string][]string
+	rules  []aclRule
+}
+
+type aclRule struct {
+	who      string
+	patterns []*regexp.Regexp
+}
+
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a, err := parseACL(f)
+	if err != nil {
+		return nil, fmt.Errorf("ACL: %v: %v", path, err)
+	}
+	return a, nil
+}
+
+func parseACL(r io.Reader) (*ACL, error) {
+	a := &ACL{groups: make(map[string][]string)}
+
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %v: Expected '%v <name> ...'", line, fields[0])
+		}
+
+		switch fields[0] {
+		case "group":
+			a.groups[fields[1]] = append(a.groups[fields[1]], fields[2:]...)
+		case "allow":
+			rule := aclRule{who: fields[1]}
+			for _, p := range fields[2:] {
+				rule.patterns = append(rule.patterns, compileACLPattern(p))
+			}
+			a.rules = append(a.rules, rule)
+		default:
+			return nil, fmt.Errorf("line %v: Unknown directive '%v'", line, fields[0])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, rule := range a.rules {
+		if group := strings.TrimPrefix(rule.who, "@"); group != rule.who && a.groups[group] == nil {
+			return nil, fmt.Errorf("Unknown group '%v'", group)
+		}
+	}
+	return a, nil
+}
+
+func compileACLPattern(pattern string) *regexp.Regexp {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, `\.\.\.`, `.*`, -1)
+	re = strings.Replace(re, `\*`, `[^/]*`, -1)
+	return regexp.MustCompile("^" + re + "$")
+}
+
+// Does this rule apply to the given user? Anonymous users are "".
+func (a *ACL) applies(rule aclRule, user string) bool {
+	if rule.who == "*" || (user != "" && rule.who == user) {
+		return true
+	}
+	if group := strings.TrimPrefix(rule.who, "@"); group != rule.who && user != "" {
+		for _, member := range a.groups[group] {
+			if member == user {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// May the user proxy the repository, ex. "github.com/user/repo"?
+func (a *ACL) Allowed(user, repo string) bool {
+	for _, rule := range a.rules {
+		if !a.applies(rule, user) {
+			continue
+		}
+		for _, p := range rule.patterns {
+			if p.MatchString(repo) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestACLAllowed(t *testing.T) {
+	a, err := parseACL(strings.NewReader(`
+# Everyone
+allow * github.com/golang/*
+
+group devs alice bob
+allow @devs github.com/acme/... gitlab.com/acme/tools
+allow carol github.com/carol/*
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		user    string
+		repo    string
+		allowed bool
+	}{
+		{"", "github.com/golang/go", true},
+		{"carol", "github.com/golang/go", true},
+		{"alice", "github.com/acme/widget", true},
+		{"bob", "github.com/acme/sub/widget", true},
+		{"bob", "gitlab.com/acme/tools", true},
+		{"bob", "gitlab.com/acme/other", false},
+		{"carol", "github.com/acme/widget", false},
+		{"carol", "github.com/carol/x", true},
+		{"carol", "github.com/carol/x/y", false},
+		{"", "github.com/carol/x", false},
+		{"alice", "github.com/acme", false},
+	}
+
+	for _, tt := range tests {
+		if allowed := a.Allowed(tt.user, tt.repo); allowed != tt.allowed {
+			t.Errorf("Allowed(%v, %v): Expected %v, got %v", tt.user, tt.repo, tt.allowed, allowed)
+		}
+	}
+
+	for _, bad := range []string{"allow alice", "deny alice github.com/*", "allow @nobody github.com/*"} {
+		if _, err := parseACL(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected '%v' to be rejected", bad)
+		}
+	}
+}
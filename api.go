@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type resolveCandidate struct {
+	Ref    string `json:"ref"`
+	Commit string `json:"commit"`
+}
+
+// The answer to /_api/resolve.
+type resolveResponse struct {
+	Repo    string `json:"repo"`
+	Version string `json:"version"`
+	// The matched ref; empty for a full SHA.
+	Ref    string `json:"ref,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	// How the version matched: "ref", "tag", "branch", "sha", "semver" or
+	// "sha-prefix".
+	Kind string `json:"kind,omitempty"`
+	// When the refs were fetched from upstream; older if they are cached.
+	Fetched    time.Time           `json:"fetched"`
+	Candidates []*resolveCandidate `json:"candidates,omitempty"`
+	Error      string              `json:"error,omitempty"`
+}
+
+// Resolve a version of a repository without cloning, ex.
+// /_api/resolve?repo=github.com/foo/bar&version=v1.2. The version can also be
+// given in repo, as in "github.com/foo/bar@v1.2".
+func (p *Proxy) serveResolve(w http.ResponseWriter, r *http.Request) {
+	res := &resolveResponse{}
+	status := p.resolve(r, res)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// Fill in res for the request, returning the HTTP status.
+func (p *Proxy) resolve(r *http.Request, res *resolveResponse) int {
+	ip, err := p.hosts.ParseImportPath((&url.URL{Path: r.URL.Query().Get("repo")}).EscapedPath())
+	if err == ErrUnknownHost {
+		res.Error = fmt.Sprintf("Unknown host in '%v'", r.URL.Query().Get("repo"))
+		return 404
+	} else if err != nil {
+		res.Error = err.Error()
+		return 400
+	}
+	res.Repo = ip.Root()
+
+	res.Version = r.URL.Query().Get("version")
+	if res.Version != "" && ip.Commitish != "" {
+		res.Error = ErrMultipleVersions.Error()
+		return 400
+	} else if res.Version == "" {
+		res.Version = ip.Commitish
+	}
+	if res.Version == "" {
+		res.Error = "No version given"
+		return 400
+	}
+
+	if err := p.checkAccess(r, ip); err != nil {
+		res.Error = err.Error()
+		return errorStatus(err)
+	}
+
+	repoUrl := ip.Host.RepoURL(ip.Repo)
+	adv, err := p.advertisement(repoUrl, r.Header)
+	if err != nil {
+		res.Error = err.Error()
+		return errorStatus(err)
+	}
+	res.Fetched = adv.fetched
+
+	var ambiguous *AmbiguousCommitishError
+	res.Ref, _, err = adv.findRef(res.Version)
+	if errors.As(err, &ambiguous) {
+		for _, c := range ambiguous.Candidates {
+			commit, ref, _ := strings.Cut(c, " ")
+			res.Candidates = append(res.Candidates, &resolveCandidate{ref, commit})
+		}
+	}
+	if err == nil {
+		res.Kind = matchKind(adv, res.Version, res.Ref)
+		// The commit that would be served, which the version log may pin
+		err = p.pin(adv, repoUrl, res.Version)
+	}
+	if err != nil {
+		res.Error = err.Error()
+		return errorStatus(err)
+	}
+	res.Commit = adv.refs["HEAD"]
+	return 200
+}
+
+// How findRef matched version to ref, see resolveResponse.
+func matchKind(adv *GitUploadPack, version, ref string) string {
+	switch {
+	case ref == "":
+		return "sha"
+	case ref == "refs/tags/"+version:
+		return "tag"
+	case ref == "refs/heads/"+version:
+		return "branch"
+	case ref == version:
+		return "ref"
+	case len(version) >= 4 && isHex(version) && (strings.HasPrefix(adv.refs[ref], strings.ToLower(version)) ||
+		strings.HasPrefix(adv.peeled(ref), strings.ToLower(version))):
+		return "sha-prefix"
+	}
+	return "semver"
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServeResolve(t *testing.T) {
+	p, upstream := newTestProxy(t, strings.TrimSuffix(testTagsAdvertisement, "0000")+
+		writePktLine("abcd000000000000000000000000000000000000 refs/heads/a\n")+
+		writePktLine("abcd111111111111111111111111111111111111 refs/heads/b\n")+
+		"0000")
+	defer upstream.Close()
+
+	var tests = []struct {
+		query  string
+		status int
+		exp    resolveResponse
+	}{
+		{"repo=git.example.com/foo/bar&version=v1.2.0", 200, resolveResponse{Ref: "refs/tags/v1.2.0", Commit: "48da4910b78e24d8d3a831839cc751700ddc6e10", Kind: "tag"}},
+		{"repo=git.example.com/foo/bar@v1.2.0", 200, resolveResponse{Ref: "refs/tags/v1.2.0", Commit: "48da4910b78e24d8d3a831839cc751700ddc6e10", Kind: "tag"}},
+		{"repo=git.example.com/foo/bar&version=^1.1", 200, resolveResponse{Ref: "refs/tags/v1.10.0", Commit: "4444444444444444444444444444444444444444", Kind: "semver"}},
+		{"repo=git.example.com/foo/bar&version=master", 200, resolveResponse{Ref: "refs/heads/master", Commit: "c7d3d3371baa35587fb66d8a79c6d999a4dafd8e", Kind: "branch"}},
+		{"repo=git.example.com/foo/bar&version=48DA4910", 200, resolveResponse{Ref: "refs/tags/v1.2.0", Commit: "48da4910b78e24d8d3a831839cc751700ddc6e10", Kind: "sha-prefix"}},
+		{"repo=git.example.com/foo/bar&version=9999999999999999999999999999999999999999", 200, resolveResponse{Commit: "9999999999999999999999999999999999999999", Kind: "sha"}},
+		{"repo=git.example.com/foo/bar&version=abcd", 404, resolveResponse{
+			Candidates: []*resolveCandidate{
+				{"refs/heads/a", "abcd000000000000000000000000000000000000"},
+				{"refs/heads/b", "abcd111111111111111111111111111111111111"},
+			},
+		}},
+		{"repo=git.example.com/foo/bar&version=v9", 404, resolveResponse{Error: "Commitish not found"}},
+		{"repo=git.example.com/foo/bar", 400, resolveResponse{Error: "No version given"}},
+		{"repo=git.example.com/foo/bar@v1&version=v1", 400, resolveResponse{Error: ErrMultipleVersions.Error()}},
+		{"repo=unknown.example.com/foo/bar&version=v1", 404, resolveResponse{Error: "Unknown host in 'unknown.example.com/foo/bar'"}},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		p.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/_api/resolve?"+tt.query, nil))
+		var res resolveResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Errorf("%v: Invalid JSON %q: %v", tt.query, w.Body.String(), err)
+			continue
+		}
+		if w.Code == 200 && res.Fetched.IsZero() {
+			t.Errorf("%v: Expected the fetch time", tt.query)
+		}
+		res.Repo, res.Version, res.Fetched = "", "", tt.exp.Fetched
+		if tt.exp.Candidates != nil {
+			res.Error = ""
+		}
+		if w.Code != tt.status || !reflect.DeepEqual(res, tt.exp) {
+			t.Errorf("%v: Expected %v %+v, got %v %q", tt.query, tt.status, tt.exp, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// An on-disk cache of info/refs advertisements, keyed by upstream repository
+// URL. Entries younger than ttl are served as is; entries younger than
+// ttl+stale are served while being refreshed in the background. Older entries
+// are refreshed before being served, unless upstream fails, in which case the
+// stale entry is better than nothing.
+//
+// Concurrent refreshes of the same key result in a single upstream fetch.
+type RefsCache struct {
+	dir   string
+	ttl   time.Duration
+	stale time.Duration
+	// Serve entries regardless of age and only fetch on a miss, where the
+	// mirrors may have the repository.
+	offline bool
+
+	mu       sync.Mutex
+	inflight map[string]*refsFetch
+}
+
+type refsFetch struct {
+	done    chan struct{}
+	body    []byte
+	fetched time.Time
+	err     error
+}
+
+func NewRefsCache(dir string, ttl, stale time.Duration) (*RefsCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &RefsCache{dir: dir, ttl: ttl, stale: stale, inflight: make(map[string]*refsFetch)}, nil
+}
+
+func (c *RefsCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// Read an entry and the time it was fetched from upstream.
+func (c *RefsCache) load(key string) ([]byte, time.Time, error) {
+	path := c.path(key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	body, err := ioutil.ReadFile(path)
+	return body, info.ModTime(), err
+}
+
+func (c *RefsCache) store(key string, body []byte, fetched time.Time) error {
+	tmp, err := ioutil.TempFile(c.dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), fetched, fetched); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(key))
+}
+
+// Get the advertisement for key, calling fetch if it needs refreshing.
+// Returns the body and when it was fetched from upstream.
+func (c *RefsCache) Get(key string, fetch func() ([]byte, error)) ([]byte, time.Time, error) {
+	body, fetched, err := c.load(key)
+	if c.offline {
+		if err != nil {
+			body, err := fetch()
+			return body, time.Now(), err
+		}
+		return body, fetched, nil
+	}
+	if err == nil {
+		age := time.Since(fetched)
+		if age < c.ttl {
+			return body, fetched, nil
+		} else if age < c.ttl+c.stale {
+			go c.refresh(key, fetch)
+			return body, fetched, nil
+		}
+	}
+
+	newBody, newFetched, fetchErr := c.refresh(key, fetch)
+	if fetchErr != nil {
+		if err == nil {
+			log.Printf("Cache: Serving stale %v: %v", key, fetchErr)
+			return body, fetched, nil
+		}
+		return nil, time.Time{}, fetchErr
+	}
+	return newBody, newFetched, nil
+}
+
+// Fetch key from upstream and store it, or wait for a fetch already running.
+func (c *RefsCache) refresh(key string, fetch func() ([]byte, error)) ([]byte, time.Time, error) {
+	c.mu.Lock()
+	if f, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-f.done
+		return f.body, f.fetched, f.err
+	}
+	f := &refsFetch{done: make(chan struct{})}
+	c.inflight[key] = f
+	c.mu.Unlock()
+
+	f.fetched = time.Now()
+	f.body, f.err = fetch()
+	if f.err == nil {
+		if err := c.store(key, f.body, f.fetched); err != nil {
+			log.Printf("Cache: Cannot store %v: %v", key, err)
+		}
+	}
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	close(f.done)
+
+	return f.body, f.fetched, f.err
+}
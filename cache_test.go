@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T) (*RefsCache, func()) {
+	dir, err := ioutil.TempDir("", "gvp-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewRefsCache(dir, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, func() { os.RemoveAll(dir) }
+}
+
+func (c *RefsCache) refreshing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.inflight) > 0
+}
+
+func TestRefsCacheGet(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+
+	var fetches, fail int32
+	fetch := func() ([]byte, error) {
+		atomic.AddInt32(&fetches, 1)
+		if atomic.LoadInt32(&fail) != 0 {
+			return nil, errors.New("upstream down")
+		}
+		return []byte("new"), nil
+	}
+
+	var tests = []struct {
+		age     time.Duration // Of the stored entry; 0 for none
+		fail    bool
+		body    string
+		fetches int32
+	}{
+		{0, false, "new", 1},
+		{0, true, "", 1},
+		{30 * time.Second, false, "old", 0},
+		{30 * time.Minute, false, "old", 1}, // Served stale, refreshed in the background
+		{2 * time.Hour, false, "new", 1},
+		{2 * time.Hour, true, "old", 1}, // Upstream errors serve stale
+	}
+
+	for i, tt := range tests {
+		os.Remove(c.path("key"))
+		if tt.age != 0 {
+			c.store("key", []byte("old"), time.Now().Add(-tt.age))
+		}
+		atomic.StoreInt32(&fail, 0)
+		if tt.fail {
+			atomic.StoreInt32(&fail, 1)
+		}
+		atomic.StoreInt32(&fetches, 0)
+
+		body, _, err := c.Get("key", fetch)
+		if string(body) != tt.body || (err != nil) != (tt.body == "") {
+			t.Errorf("Test %v: Expected %q, got %q and %v", i, tt.body, body, err)
+		}
+
+		// Wait for background refreshes
+		for j := 0; j < 100 && (atomic.LoadInt32(&fetches) < tt.fetches || c.refreshing()); j++ {
+			time.Sleep(time.Millisecond)
+		}
+		if n := atomic.LoadInt32(&fetches); n != tt.fetches {
+			t.Errorf("Test %v: Expected %v fetches, got %v", i, tt.fetches, n)
+		}
+	}
+}
+
+func TestRefsCacheSingleflight(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+
+	var fetches int32
+	release := make(chan struct{})
+	fetch := func() ([]byte, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return []byte("body"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if body, _, err := c.Get("key", fetch); err != nil || string(body) != "body" {
+				t.Errorf("Unexpected %q, %v", body, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if fetches != 1 {
+		t.Errorf("Expected a single upstream fetch, got %v", fetches)
+	}
+}
+
+func TestServeGitCached(t *testing.T) {
+	var requests int32
+	p, upstream := newTestProxyWithUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(testAdvertisement))
+	}))
+	defer upstream.Close()
+
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+	p.cache = c
+
+	for _, commitish := range []string{"master", "update-docs", "c7d3"} {
+		w := httptest.NewRecorder()
+		p.Handler().ServeHTTP(w, httptest.NewRequest(
+			"GET", "/_git/git.example.com/foo/bar@"+commitish+"/info/refs?service=git-upload-pack", nil,
+		))
+		if w.Code != 200 {
+			t.Errorf("Expected 200 for %v, got %v", commitish, w.Code)
+		}
+	}
+
+	// Protocol v2 clients get the cached v0 advertisement
+	r := httptest.NewRequest("GET", "/_git/git.example.com/foo/bar@master/info/refs?service=git-upload-pack", nil)
+	r.Header.Set("Git-Protocol", "version=2")
+	w := httptest.NewRecorder()
+	p.Handler().ServeHTTP(w, r)
+	if w.Code != 200 || !strings.HasPrefix(w.Body.String(), "001e# service=git-upload-pack\n0000") || strings.Contains(w.Body.String(), "version 2") {
+		t.Errorf("Expected a v0 advertisement for a v2 client, got %v %q", w.Code, w.Body.String())
+	}
+
+	if requests != 1 {
+		t.Errorf("Expected one upstream request, got %v", requests)
+	}
+}
+
+func TestServeGitCachedCredentials(t *testing.T) {
+	var requests int32
+	p, upstream := newTestProxyWithUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="upstream"`)
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		w.Write([]byte(testAdvertisement))
+	}))
+	defer upstream.Close()
+
+	c := *p.config
+	c.AuthPassthrough = true
+	p, err := NewProxy(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, cleanup := newTestCache(t)
+	defer cleanup()
+	p.cache = cache
+
+	var tests = []struct {
+		auth   string
+		status int
+	}{
+		{"", 401},
+		{"Bearer secret", 200},
+		{"Bearer secret", 200},
+		// Not served what the previous client was allowed to see
+		{"", 401},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/_git/git.example.com/foo/bar@master/info/refs?service=git-upload-pack", nil)
+		r.Header.Set("User-Agent", "git/2.43.0")
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		p.Handler().ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("GET with '%v': Expected %v, got %v %q", tt.auth, tt.status, w.Code, w.Body.String())
+		}
+		if w.Code == 401 && w.Header().Get("WWW-Authenticate") != `Basic realm="upstream"` {
+			t.Errorf("Expected upstream's WWW-Authenticate with the 401, got %v", w.Header())
+		}
+	}
+
+	if requests != 4 {
+		t.Errorf("Expected every request to go upstream, got %v", requests)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The users allowed to use the proxy: passwords from an htpasswd file and
+// bearer tokens from a token file.
+type Users struct {
+	passwords map[string]string // User to htpasswd hash
+	tokens    map[[sha256.Size]byte]string
+}
+
+// Load users from an htpasswd file and a token file, each optional. Both have
+// a "user:secret" line per entry; in the htpasswd file the secret is hashed
+// with MD5 ($apr1$ or $1$) or SHA-1 ({SHA}), in the token file it is the
+// token itself.
+func LoadUsers(htpasswd, tokenFile string) (*Users, error) {
+	u := &Users{passwords: make(map[string]string), tokens: make(map[[sha256.Size]byte]string)}
+
+	if htpasswd != "" {
+		err := readUserFile(htpasswd, func(user, hash string) error {
+			if !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "$1$") && !strings.HasPrefix(hash, "{SHA}") {
+				return fmt.Errorf("Unsupported hash for %v, use htpasswd -m or -s", user)
+			}
+			u.passwords[user] = hash
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if tokenFile != "" {
+		err := readUserFile(tokenFile, func(user, token string) error {
+			u.tokens[sha256.Sum256([]byte(token))] = user
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// Call fn with each "user:secret" line of a file, skipping blank lines and
+// comments.
+func readUserFile(path string, fn func(user, secret string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("Users: %v:%v: Expected 'user:secret'", path, line)
+		}
+		if err := fn(parts[0], parts[1]); err != nil {
+			return fmt.Errorf("Users: %v:%v: %v", path, line, err)
+		}
+	}
+	return s.Err()
+}
+
+// The user a request authenticates as, if any.
+func (u *Users) Authenticate(r *http.Request) (string, bool) {
+	if user, password, ok := r.BasicAuth(); ok {
+		hash, ok := u.passwords[user]
+		return user, ok && checkPassword(hash, password)
+	}
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		user, ok := u.tokens[sha256.Sum256([]byte(auth[7:]))]
+		return user, ok
+	}
+	return "", false
+}
+
+func checkPassword(hash, password string) bool {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "$1$"):
+		magic := hash[:strings.Index(hash[1:], "$")+2]
+		salt := strings.SplitN(hash[len(magic):], "$", 2)[0]
+		computed = md5Crypt(password, salt, magic)
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// The MD5-based crypt(3) used by htpasswd ($apr1$) and older Unices ($1$).
+func md5Crypt(password, salt, magic string) string {
+	pw := []byte(password)
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.New()
+	io.WriteString(alt, password+salt+password)
+	mixin := alt.Sum(nil)
+
+	d := md5.New()
+	io.WriteString(d, password+magic+salt)
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(mixin)
+		} else {
+			d.Write(mixin[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	final := d.Sum(nil)
+
+	// Deliberately slow
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 == 1 {
+			d.Write(pw)
+		} else {
+			d.Write(final)
+		}
+		if i%3 != 0 {
+			io.WriteString(d, salt)
+		}
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+		if i&1 == 1 {
+			d.Write(final)
+		} else {
+			d.Write(pw)
+		}
+		final = d.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	out := []byte(magic + salt + "$")
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[i[0]])<<16|uint(final[i[1]])<<8|uint(final[i[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+	return string(out)
+}
+
+type userKey struct{}
+
+// The authenticated user of a request; empty if there is none.
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+// Only let authenticated users through to next.
+func (u *Users) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := u.Authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git-version-proxy"`)
+			http.Error(w, "Authentication required", 401)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	var tests = []struct {
+		hash     string
+		password string
+		ok       bool
+	}{
+		{"$apr1$Ks2Tp0Qf$nE5ItyW35RYXU2pwJBs8c.", "secret", true},
+		{"$apr1$Ks2Tp0Qf$nE5ItyW35RYXU2pwJBs8c.", "Secret", false},
+		{"$1$abcdefgh$G//4keteveJp0qb8z2DxG/", "password", true},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret", true},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "", false},
+		{"secret", "secret", false},
+	}
+
+	for _, tt := range tests {
+		if ok := checkPassword(tt.hash, tt.password); ok != tt.ok {
+			t.Errorf("checkPassword(%v, %v): Expected %v, got %v", tt.hash, tt.password, tt.ok, ok)
+		}
+	}
+}
+
+// Set up a proxy with users alice (password secret, token t0ken) and bob
+// (password password), where only alice may use foo/bar.
+func newTestProxyWithUsers(t *testing.T) (*Proxy, func()) {
+	dir, err := ioutil.TempDir("", "gvp-users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"htpasswd": "alice:$apr1$Ks2Tp0Qf$nE5ItyW35RYXU2pwJBs8c.\nbob:$1$abcdefgh$G//4keteveJp0qb8z2DxG/\n",
+		"tokens":   "# CI\nalice:t0ken\n",
+		"acl":      "group devs alice\nallow @devs git.example.com/foo/...\nallow * git.example.com/public/*\n",
+	}
+	for name, content := range files {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+
+	p, upstream := newTestProxy(t, testAdvertisement)
+	c := *p.config
+	c.Htpasswd = filepath.Join(dir, "htpasswd")
+	c.TokenFile = filepath.Join(dir, "tokens")
+	c.ACL = filepath.Join(dir, "acl")
+	if p, err = NewProxy(&c); err != nil {
+		t.Fatal(err)
+	}
+	return p, func() {
+		upstream.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	p, done := newTestProxyWithUsers(t)
+	defer done()
+
+	var tests = []struct {
+		path   string
+		user   string
+		pass   string
+		token  string
+		status int
+	}{
+		{"/_git/git.example.com/foo/bar@master/info/refs?service=git-upload-pack", "", "", "", 401},
+		{"/_git/git.example.com/foo/bar@master/info/refs?service=git-upload-pack", "alice", "wrong", "", 401},
+		{"/_git/git.example.com/foo/bar@master/info/refs?service=git-upload-pack", "", "", "wrong", 401},
+		{"/_git/git.example.com/foo/bar@master/info/refs?service=git-upload-pack", "alice", "secret", "", 200},
+		{"/_git/git.example.com/foo/bar@master/info/refs?service=git-upload-pack", "", "", "t0ken", 200},
+		{"/_git/git.example.com/foo/bar@master/info/refs?service=git-upload-pack", "bob", "password", "", 403},
+		{"/_git/git.example.com/public/bar@master/info/refs?service=git-upload-pack", "bob", "password", "", 200},
+		{"/git.example.com/foo/bar@master/sub?go-get=1", "alice", "secret", "", 200},
+		{"/git.example.com/foo/bar@master/sub?go-get=1", "bob", "password", "", 403},
+		{"/git.example.com/public/bar@master?go-get=1", "bob", "password", "", 200},
+		{"/git.example.com/foo/bar/@v/list", "bob", "password", "", 403},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.pass)
+		}
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		p.Handler().ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("GET %v as '%v%v': Expected %v, got %v", tt.path, tt.user, tt.token, tt.status, w.Code)
+		}
+		if w.Code == 401 && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("GET %v: Expected a WWW-Authenticate header with the 401", tt.path)
+		}
+	}
+}
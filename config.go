@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"os"
+	"time"
+)
+
+// Config holds the settings that used to be hardcoded into main(). It can be
+// loaded from a JSON file and/or overridden on the command line.
+type Config struct {
+	// Address the HTTP server binds to, ex. ":8080".
+	Listen string `json:"listen"`
+	// Externally visible host (and port), used in go-import meta tags and the
+	// /_git repo URL, ex. "goproxy.example.com".
+	Host string `json:"host"`
+	// Externally visible scheme, "http" or "https".
+	Scheme string `json:"scheme"`
+	// Upstream hosts in addition to the defaults, see HostRegistry.
+	Hosts []*Host `json:"hosts"`
+	// Hide all refs but HEAD, the default branch and the pinned tag when a
+	// version is requested.
+	OnlyPinned bool `json:"only_pinned"`
+	// Directory to cache info/refs advertisements in; no caching if empty.
+	CacheDir string `json:"cache_dir"`
+	// How long cached advertisements are fresh, and for how long after that
+	// they may be served while being refreshed in the background.
+	CacheTTL   Duration `json:"cache_ttl"`
+	CacheStale Duration `json:"cache_stale"`
+	// Directory to keep bare mirrors of upstream repositories in, to serve
+	// clients from; no mirrors if empty. They are fetched again once older
+	// than MirrorRefresh.
+	MirrorDir     string   `json:"mirror_dir"`
+	MirrorRefresh Duration `json:"mirror_refresh"`
+	// Never contact upstream; serve only what is in the cache and mirrors.
+	Offline bool `json:"offline"`
+	// File recording the commit each tag first resolved to; not kept if
+	// empty. VersionPolicy says what to do when a tag has since moved:
+	// "keep" serving the recorded commit, or "refuse" the request.
+	VersionLog    string `json:"version_log"`
+	VersionPolicy string `json:"version_policy"`
+	// Credentials for upstream hosts by hostname, and a netrc file to take
+	// them from for hosts not listed.
+	Credentials map[string]*Credential `json:"credentials"`
+	Netrc       string                 `json:"netrc"`
+	// Pass the Authorization header clients send on to upstream, instead of
+	// dropping it.
+	AuthPassthrough bool `json:"auth_passthrough"`
+	// Require clients to log in with a password from the htpasswd file or a
+	// bearer token from the token file, if either is set.
+	Htpasswd  string `json:"htpasswd"`
+	TokenFile string `json:"token_file"`
+	// File listing which users may proxy which repositories; anyone may
+	// proxy anything if empty.
+	ACL string `json:"acl"`
+	// Patterns of upstream repositories ("host/owner/repo", as in ACL files)
+	// the proxy may and may not fetch; anything not denied is allowed if
+	// UpstreamAllow is empty.
+	UpstreamAllow []string `json:"upstream_allow"`
+	UpstreamDeny  []string `json:"upstream_deny"`
+	// Allow upstreams on loopback, private and link-local addresses.
+	AllowPrivateNetworks bool `json:"allow_private_networks"`
+}
+
+// A time.Duration written as "5m" or "90s" in JSON.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Listen: ":8080",
+		Host:   "127.0.0.1:8080",
+		Scheme: "http",
+
+		CacheTTL:   Duration{time.Minute},
+		CacheStale: Duration{time.Hour},
+
+		MirrorRefresh: Duration{5 * time.Minute},
+
+		VersionPolicy: VersionPolicyKeep,
+	}
+}
+
+// Read a JSON config file on top of whatever is already set in c.
+func (c *Config) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(c); err != nil {
+		return fmt.Errorf("Config: Cannot parse %v: %v", path, err)
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	if c.Host == "" {
+		return fmt.Errorf("Config: host must be set")
+	}
+	if c.Scheme != "http" && c.Scheme != "https" {
+		return fmt.Errorf("Config: scheme must be http or https, got '%v'", c.Scheme)
+	}
+	if c.Offline && c.MirrorDir == "" {
+		return fmt.Errorf("Config: offline needs mirror_dir, as the cache only has refs")
+	}
+	// Clients log in to the proxy with the same header; it must not go upstream
+	if c.AuthPassthrough && (c.Htpasswd != "" || c.TokenFile != "") {
+		return fmt.Errorf("Config: auth_passthrough cannot be used with htpasswd or token_file")
+	}
+	if c.VersionPolicy != VersionPolicyKeep && c.VersionPolicy != VersionPolicyRefuse {
+		return fmt.Errorf("Config: version_policy must be keep or refuse, got '%v'", c.VersionPolicy)
+	}
+	_, err := c.HostRegistry()
+	return err
+}
+
+// Build the registry of upstream hosts: the defaults plus the configured ones.
+func (c *Config) HostRegistry() (*HostRegistry, error) {
+	r := NewHostRegistry()
+	for _, h := range c.Hosts {
+		if err := r.Add(h); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Parse command line arguments into a Config. Flags given explicitly take
+// precedence over the config file.
+func parseFlags(args []string) (*Config, error) {
+	c := NewConfig()
+	fs := flag.NewFlagSet("git-version-proxy", flag.ContinueOnError)
+
+	configFile := fs.String("config", "", "JSON config file")
+	listen := fs.String("listen", c.Listen, "Address to listen on")
+	host := fs.String("host", c.Host, "Public host (and port) used in go-import meta tags")
+	scheme := fs.String("scheme", c.Scheme, "Public scheme (http or https)")
+	onlyPinned := fs.Bool("only-pinned", c.OnlyPinned, "Only advertise the pinned version's refs")
+	cacheDir := fs.String("cache-dir", c.CacheDir, "Directory to cache upstream refs in")
+	cacheTTL := fs.Duration("cache-ttl", c.CacheTTL.Duration, "How long cached refs are fresh")
+	cacheStale := fs.Duration("cache-stale", c.CacheStale.Duration, "How long stale refs are served while refreshing")
+	mirrorDir := fs.String("mirror-dir", c.MirrorDir, "Directory to keep bare mirrors of upstream repositories in")
+	mirrorRefresh := fs.Duration("mirror-refresh", c.MirrorRefresh.Duration, "How often mirrors are fetched again")
+	offline := fs.Bool("offline", c.Offline, "Never contact upstream; serve from cache and mirrors only")
+	versionLog := fs.String("version-log", c.VersionLog, "File recording the commit each tag first resolved to")
+	versionPolicy := fs.String("version-policy", c.VersionPolicy, "What to do with moved tags (keep or refuse)")
+	netrc := fs.String("netrc", c.Netrc, "netrc file with credentials for upstream hosts")
+	authPassthrough := fs.Bool("auth-passthrough", c.AuthPassthrough, "Pass clients' Authorization headers on to upstream")
+	htpasswd := fs.String("htpasswd", c.Htpasswd, "htpasswd file with the users allowed to use the proxy")
+	tokenFile := fs.String("token-file", c.TokenFile, "File with user:token lines for bearer authentication")
+	acl := fs.String("acl", c.ACL, "File listing which users may proxy which repositories")
+	allowPrivate := fs.Bool("allow-private-networks", c.AllowPrivateNetworks, "Allow upstreams on private addresses")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := c.LoadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			c.Listen = *listen
+		case "host":
+			c.Host = *host
+		case "scheme":
+			c.Scheme = *scheme
+		case "only-pinned":
+			c.OnlyPinned = *onlyPinned
+		case "cache-dir":
+			c.CacheDir = *cacheDir
+		case "cache-ttl":
+			c.CacheTTL.Duration = *cacheTTL
+		case "cache-stale":
+			c.CacheStale.Duration = *cacheStale
+		case "mirror-dir":
+			c.MirrorDir = *mirrorDir
+		case "mirror-refresh":
+			c.MirrorRefresh.Duration = *mirrorRefresh
+		case "offline":
+			c.Offline = *offline
+		case "version-log":
+			c.VersionLog = *versionLog
+		case "version-policy":
+			c.VersionPolicy = *versionPolicy
+		case "netrc":
+			c.Netrc = *netrc
+		case "auth-passthrough":
+			c.AuthPassthrough = *authPassthrough
+		case "htpasswd":
+			c.Htpasswd = *htpasswd
+		case "token-file":
+			c.TokenFile = *tokenFile
+		case "acl":
+			c.ACL = *acl
+		case "allow-private-networks":
+			c.AllowPrivateNetworks = *allowPrivate
+		}
+	})
+
+	return c, c.Validate()
+}
+
+// Base URL clients should use to reach the proxy, ex. "http://127.0.0.1:8080".
+func (c *Config) BaseURL() string {
+	return fmt.Sprintf("%s://%s", c.Scheme, c.Host)
+}
+
+// The go-import meta tag for the repository root at the given path (without
+// the host), ex. "/github.com/foo/bar@v1".
+func (c *Config) GoImportMeta(root string) string {
+	return fmt.Sprintf(
+		"<meta name=\"go-import\" content=\"%s git %s\"></meta>",
+		html.EscapeString(c.Host+root), html.EscapeString(c.BaseURL()+"/_git"+root),
+	)
+}
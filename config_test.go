@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gvp-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(file, []byte(`{"listen": ":9000", "host": "go.example.com", "scheme": "https"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only valid once the flags are in
+	partial := filepath.Join(dir, "partial.json")
+	if err := ioutil.WriteFile(partial, []byte(`{"scheme": "ftp"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		args   []string
+		listen string
+		host   string
+		scheme string
+	}{
+		{[]string{}, ":8080", "127.0.0.1:8080", "http"},
+		{[]string{"-listen", ":80", "-host", "go.internal"}, ":80", "go.internal", "http"},
+		{[]string{"-config", file}, ":9000", "go.example.com", "https"},
+		{[]string{"-config", file, "-host", "other.example.com"}, ":9000", "other.example.com", "https"},
+		{[]string{"-config", partial, "-scheme", "https"}, ":8080", "127.0.0.1:8080", "https"},
+	}
+
+	for _, tt := range tests {
+		c, err := parseFlags(tt.args)
+		if err != nil {
+			t.Errorf("parseFlags(%v) failed: %v", tt.args, err)
+			continue
+		}
+		if c.Listen != tt.listen || c.Host != tt.host || c.Scheme != tt.scheme {
+			t.Errorf(
+				"parseFlags(%v): expected (%v, %v, %v), got (%v, %v, %v)",
+				tt.args, tt.listen, tt.host, tt.scheme, c.Listen, c.Host, c.Scheme,
+			)
+		}
+	}
+
+	if _, err := parseFlags([]string{"-scheme", "ftp"}); err == nil {
+		t.Errorf("Expected scheme ftp to be rejected.")
+	}
+	if _, err := parseFlags([]string{"-offline", "-cache-dir", dir}); err == nil {
+		t.Errorf("Expected offline without mirror to be rejected.")
+	}
+	if _, err := parseFlags([]string{"-version-policy", "ignore"}); err == nil {
+		t.Errorf("Expected version policy ignore to be rejected.")
+	}
+	if _, err := parseFlags([]string{"-auth-passthrough", "-htpasswd", "users"}); err == nil {
+		t.Errorf("Expected auth passthrough with htpasswd to be rejected.")
+	}
+}
+
+func TestGoImportMeta(t *testing.T) {
+	c := &Config{Host: "go.example.com", Scheme: "https"}
+	exp := `<meta name="go-import" content="go.example.com/github.com/foo/bar@v1 git https://go.example.com/_git/github.com/foo/bar@v1"></meta>`
+
+	if got := c.GoImportMeta("/github.com/foo/bar@v1"); got != exp {
+		t.Errorf("Expected\n\t%v\nGot\n\t%v", exp, got)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Credentials for an upstream host: either a bearer token or a username and
+// password. Hosts expecting tokens as passwords, like GitHub, take the latter.
+type Credential struct {
+	Token    string `json:"token"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// The Authorization header to send.
+func (c *Credential) header() string {
+	if c.Token != "" {
+		return "Bearer " + c.Token
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
+}
+
+// Credentials for upstream hosts, from the config and/or a netrc file.
+type Credentials struct {
+	hosts map[string]*Credential
+	// From the netrc file; "" is its default entry.
+	netrc map[string]*Credential
+}
+
+func NewCredentials(hosts map[string]*Credential, netrcPath string) (*Credentials, error) {
+	for name, c := range hosts {
+		if c == nil || (c.Token == "") == (c.Username == "") {
+			return nil, fmt.Errorf("Credentials: %v needs either a token or a username", name)
+		}
+	}
+	c := &Credentials{hosts: hosts}
+	if netrcPath == "" {
+		return c, nil
+	}
+
+	f, err := os.Open(netrcPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if c.netrc, err = parseNetrc(f); err != nil {
+		return nil, fmt.Errorf("Credentials: Cannot parse %v: %v", netrcPath, err)
+	}
+	return c, nil
+}
+
+// Find the credentials for a host, ex. "github.com" or "git.example.com:8443".
+// Configured hosts win over the netrc file, and exact host:port matches over
+// the hostname alone.
+func (c *Credentials) lookup(host string) *Credential {
+	if c == nil {
+		return nil
+	}
+	name := host
+	if u, err := url.Parse("//" + host); err == nil {
+		name = u.Hostname()
+	}
+	for _, m := range []map[string]*Credential{c.hosts, c.netrc} {
+		if cred, ok := m[host]; ok {
+			return cred
+		} else if cred, ok := m[name]; ok {
+			return cred
+		}
+	}
+	return c.netrc[""]
+}
+
+// Environment for git commands talking to the given repository, so they send
+// its credentials without them showing up on the command line.
+func (c *Credentials) gitEnv(repoUrl string) []string {
+	u, err := url.Parse(repoUrl)
+	if err != nil {
+		return nil
+	}
+	cred := c.lookup(u.Host)
+	if cred == nil {
+		return nil
+	}
+	return []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: " + cred.header(),
+	}
+}
+
+// Parse the machine, login and password entries of a netrc file.
+func parseNetrc(r io.Reader) (map[string]*Credential, error) {
+	// Entries are words, which may span lines, but macros are lines
+	lines := bufio.NewScanner(r)
+	var words []string
+	next := func() (string, bool) {
+		for len(words) == 0 {
+			if !lines.Scan() {
+				return "", false
+			}
+			words = strings.Fields(lines.Text())
+		}
+		word := words[0]
+		words = words[1:]
+		return word, true
+	}
+
+	out := make(map[string]*Credential)
+	var cur *Credential
+	for {
+		word, ok := next()
+		if !ok {
+			break
+		}
+		switch word {
+		case "machine", "default":
+			cur = &Credential{}
+			name := ""
+			if word == "machine" {
+				if name, ok = next(); !ok {
+					return nil, fmt.Errorf("Expected a name after machine")
+				}
+			}
+			if _, ok := out[name]; !ok {
+				out[name] = cur
+			}
+		case "login", "password", "account":
+			value, ok := next()
+			if !ok {
+				return nil, fmt.Errorf("Expected a value after %v", word)
+			}
+			if cur == nil {
+				return nil, fmt.Errorf("%v outside of a machine entry", word)
+			}
+			switch word {
+			case "login":
+				cur.Username = value
+			case "password":
+				cur.Password = value
+			}
+		case "macdef":
+			// The rest of the line names the macro, which runs until a
+			// blank line
+			words = nil
+			for lines.Scan() && strings.TrimSpace(lines.Text()) != "" {
+			}
+		default:
+			return nil, fmt.Errorf("Unexpected '%v'", word)
+		}
+	}
+	return out, lines.Err()
+}
+
+// A transport adding the configured credentials to requests to upstream.
+// Authorization headers from clients are dropped, unless passthrough is set,
+// in which case they win over the configured ones.
+type authTransport struct {
+	credentials *Credentials
+	passthrough bool
+	next        http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	auth := ""
+	if t.passthrough {
+		auth = req.Header.Get("Authorization")
+	}
+	if cred := t.credentials.lookup(req.URL.Host); auth == "" && cred != nil {
+		auth = cred.header()
+	}
+	if auth == req.Header.Get("Authorization") {
+		return t.next.RoundTrip(req)
+	}
+
+	// RoundTrippers must not modify the request
+	req = req.Clone(req.Context())
+	req.Header.Del("Authorization")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	return t.next.RoundTrip(req)
+}
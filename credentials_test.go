@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseNetrc(t *testing.T) {
+	netrc := `machine git.example.com login alice password secret
+machine other.example.com
+	login bob
+	account ignored
+	password hunter2
+macdef init
+	cd /pub
+	machine ignored.example.com login mallory password mallory
+
+machine after.example.com login carol password macro
+default login anonymous password guest
+`
+	creds, err := parseNetrc(strings.NewReader(netrc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		machine  string
+		username string
+		password string
+	}{
+		{"git.example.com", "alice", "secret"},
+		{"other.example.com", "bob", "hunter2"},
+		{"after.example.com", "carol", "macro"},
+		{"", "anonymous", "guest"},
+	}
+	if _, ok := creds["ignored.example.com"]; ok {
+		t.Errorf("Did not expect the macro to be taken for a machine entry")
+	}
+	for _, tt := range tests {
+		c, ok := creds[tt.machine]
+		if !ok || c.Username != tt.username || c.Password != tt.password {
+			t.Errorf("Machine '%v': Expected %v:%v, got %+v", tt.machine, tt.username, tt.password, c)
+		}
+	}
+
+	for _, bad := range []string{"machine", "login alice", "machine x login", "machine x foo bar"} {
+		if _, err := parseNetrc(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected '%v' to be rejected", bad)
+		}
+	}
+}
+
+func TestCredentialsLookup(t *testing.T) {
+	c := &Credentials{
+		hosts: map[string]*Credential{
+			"github.com":           {Username: "x-access-token", Password: "gh"},
+			"git.example.com:8443": {Token: "port"},
+		},
+		netrc: map[string]*Credential{
+			"github.com":      {Username: "netrc", Password: "netrc"},
+			"git.example.com": {Token: "host"},
+			"":                {Username: "anonymous", Password: "guest"},
+		},
+	}
+
+	var tests = []struct {
+		host string
+		auth string
+	}{
+		{"github.com", "Basic eC1hY2Nlc3MtdG9rZW46Z2g="},
+		{"git.example.com:8443", "Bearer port"},
+		{"git.example.com", "Bearer host"},
+		{"git.example.com:443", "Bearer host"},
+		{"gitlab.com", "Basic YW5vbnltb3VzOmd1ZXN0"},
+	}
+	for _, tt := range tests {
+		if cred := c.lookup(tt.host); cred == nil || cred.header() != tt.auth {
+			t.Errorf("Host %v: Expected %v, got %+v", tt.host, tt.auth, cred)
+		}
+	}
+
+	var none *Credentials
+	if cred := none.lookup("github.com"); cred != nil {
+		t.Errorf("Expected no credentials, got %+v", cred)
+	}
+}
+
+func TestAuthTransport(t *testing.T) {
+	var got string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	creds := &Credentials{hosts: map[string]*Credential{host: {Token: "configured"}}}
+
+	var tests = []struct {
+		credentials *Credentials
+		passthrough bool
+		incoming    string
+		exp         string
+	}{
+		{nil, false, "", ""},
+		{nil, false, "Bearer client", ""},
+		{nil, true, "Bearer client", "Bearer client"},
+		{creds, false, "", "Bearer configured"},
+		{creds, false, "Bearer client", "Bearer configured"},
+		{creds, true, "", "Bearer configured"},
+		{creds, true, "Bearer client", "Bearer client"},
+	}
+
+	for _, tt := range tests {
+		client := &http.Client{Transport: &authTransport{tt.credentials, tt.passthrough, http.DefaultTransport}}
+		req, _ := http.NewRequest("GET", upstream.URL, nil)
+		if tt.incoming != "" {
+			req.Header.Set("Authorization", tt.incoming)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if got != tt.exp {
+			t.Errorf("%+v: Expected upstream to get '%v', got '%v'", tt, tt.exp, got)
+		}
+		if req.Header.Get("Authorization") != tt.incoming {
+			t.Errorf("%+v: Request was modified", tt)
+		}
+	}
+}
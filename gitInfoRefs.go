@@ -4,42 +4,117 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+	"time"
 )
 
 type GitUploadPack struct {
-	refs         map[string]string
+	// Refs and the objects they point to; for annotated tags, the tag object.
+	refs map[string]string
+	// The commits annotated tags point to, by tag ref. Advertised as peeled
+	// "<tag>^{}" refs.
+	tags map[string]string
+	// Ref names in the order upstream advertised them.
+	order        []string
 	head         string
 	capabilities string
+
+	// Only advertise HEAD, the default branch and the pinned ref after
+	// SetMaster.
+	OnlyPinned      bool
+	pinnedRef       string
+	pinnedCommitish string
+	branch          string
+
+	// When the advertisement was fetched from upstream.
+	fetched time.Time
+
+	// Upstream's formatting, so an unmodified advertisement is written back
+	// byte for byte: the service line, the "version 1" line if any, and how
+	// ref lines end.
+	service string
+	version string
+	eol     string
 }
 
+// Refs with no SHA, advertised so an empty repository can have capabilities.
+const noRefsSHA = "0000000000000000000000000000000000000000"
+
 func NewGitUploadPack() *GitUploadPack {
-	return &GitUploadPack{refs: make(map[string]string)}
+	return &GitUploadPack{
+		refs:    make(map[string]string),
+		tags:    make(map[string]string),
+		service: "# service=git-upload-pack\n",
+		eol:     "\n",
+	}
 }
 
 func parseGitUploadPack(r io.ReadCloser) (*GitUploadPack, error) {
+	defer r.Close()
 	p := NewGitUploadPack()
+	pr := NewPktReader(r)
 
-	res, e := readPktLine(r)
-	if e != nil {
-		return nil, e
+	// First pack should be "001e# service=git-upload-pack", then a flush
+	pkt, err := pr.ReadPkt()
+	if err != nil {
+		return nil, err
 	}
-
-	// First pack should be "001e# service=git-upload-pack"
-	// Second pack is empty...
-	// Last pack is empty too...
-	refs := res[2 : len(res)-1]
-	// Thrid shoud have a standard "SHA ref\0capabilities"
-	caps := strings.SplitN(refs[0], "\000", 2)
-	if len(caps) == 2 {
-		p.capabilities = caps[1]
-		refs[0] = caps[0]
+	if pkt.Type != PktData || !strings.HasPrefix(string(pkt.Data), "# service=") {
+		return nil, fmt.Errorf("InfoRefsParser: Expected service line, got '%s'", pkt.Data)
 	}
-	// Rest is "SHA ref"
-	for _, elem := range refs {
+	p.service = string(pkt.Data)
+	if pkt, err = pr.ReadPkt(); err != nil {
+		return nil, err
+	} else if pkt.Type != PktFlush {
+		return nil, fmt.Errorf("InfoRefsParser: Expected flush after service line")
+	}
+
+	// The refs run until the next flush
+	first := true
+	for {
+		pkt, err := pr.ReadPkt()
+		if err == io.EOF {
+			return p, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return p, err
+		}
+		if pkt.Type == PktFlush {
+			break
+		} else if pkt.Type != PktData {
+			return p, fmt.Errorf("InfoRefsParser: Unexpected special packet")
+		}
+
+		elem := strings.TrimSuffix(string(pkt.Data), "\n")
+
+		// Protocol v1 announces itself before the refs
+		if first && elem == "version 1" && p.version == "" {
+			p.version = string(pkt.Data)
+			continue
+		}
+
+		// First one has a standard "SHA ref\0capabilities"
+		if first {
+			first = false
+			if !strings.HasSuffix(string(pkt.Data), "\n") {
+				p.eol = ""
+			}
+			caps := strings.SplitN(elem, "\000", 2)
+			if len(caps) == 2 {
+				p.capabilities = caps[1]
+				elem = caps[0]
+			}
+		}
+
+		// Rest is "SHA ref"
 		parts := strings.SplitN(elem, " ", 2)
-		if len(parts) == 2 && len(parts[0]) == 40 {
+		if len(parts) == 2 && len(parts[0]) == 40 && parts[1] == "capabilities^{}" {
+			// Nothing but capabilities
+		} else if len(parts) == 2 && len(parts[0]) == 40 && strings.HasSuffix(parts[1], "^{}") {
+			p.tags[strings.TrimSuffix(parts[1], "^{}")] = parts[0]
+		} else if len(parts) == 2 && len(parts[0]) == 40 {
 			p.refs[parts[1]] = parts[0]
+			p.order = append(p.order, parts[1])
 		} else {
 			return p, errors.New(fmt.Sprintf("InfoRefsParser: Unexpected input '%v'.", elem))
 		}
@@ -48,49 +123,300 @@ func parseGitUploadPack(r io.ReadCloser) (*GitUploadPack, error) {
 	return p, nil
 }
 
-func writePktLine(line string) string {
-	return fmt.Sprintf("%04x%s", len(line)+4, line)
-}
-
 func (p *GitUploadPack) String() string {
-	out := []string{
-		"001e# service=git-upload-pack\n0000",
-		writePktLine(fmt.Sprintf("%s HEAD\000%s\n", p.refs["HEAD"], p.capabilities)),
+	out := []string{writePktLine(p.service), "0000"}
+	if p.version != "" {
+		out = append(out, writePktLine(p.version))
 	}
 
-	// Write everything else
-	for ref, commit := range p.refs {
-		if ref != "HEAD" {
-			out = append(out, writePktLine(fmt.Sprintf("%s %s\n", commit, ref)))
+	// Annotated tags are followed by what they peel to
+	lines := []string{}
+	for _, ref := range p.orderedRefs() {
+		if !p.advertised(ref) {
+			continue
 		}
+		lines = append(lines, fmt.Sprintf("%s %s", p.refs[ref], ref))
+		if commit, ok := p.tags[ref]; ok {
+			lines = append(lines, fmt.Sprintf("%s %s^{}", commit, ref))
+		}
+	}
+	if len(lines) == 0 {
+		lines = append(lines, noRefsSHA+" capabilities^{}")
 	}
 
+	// Capabilities go on the first line
+	lines[0] += "\000" + p.capabilities
+	for _, line := range lines {
+		out = append(out, writePktLine(line+p.eol))
+	}
 	out = append(out, "0000")
 
 	return strings.Join(out, "")
 }
 
-func (p *GitUploadPack) findCommitish(commitish string) (error, string) {
-	// If it is a commit-ID, we should just return that
-	if len(commitish) == 40 {
-		return nil, commitish
+// All refs in the order upstream advertised them, except that HEAD always
+// comes first, and refs upstream did not have (see SetMaster) come last.
+func (p *GitUploadPack) orderedRefs() []string {
+	out := []string{}
+	seen := map[string]bool{"HEAD": true}
+	if _, ok := p.refs["HEAD"]; ok {
+		out = append(out, "HEAD")
+	}
+	for _, ref := range p.order {
+		if _, ok := p.refs[ref]; ok && !seen[ref] {
+			out = append(out, ref)
+			seen[ref] = true
+		}
 	}
 
-	// Look through the refs
+	added := []string{}
+	for ref := range p.refs {
+		if !seen[ref] {
+			added = append(added, ref)
+		}
+	}
+	sort.Strings(added)
+	return append(out, added...)
+}
+
+// Should the given ref be written by String()?
+func (p *GitUploadPack) advertised(ref string) bool {
+	if !p.OnlyPinned || p.branch == "" {
+		return true
+	}
+	switch ref {
+	case "HEAD", p.branch, p.pinnedRef:
+		return true
+	}
+	return false
+}
+
+// The commit a ref points to, looking through annotated tags.
+func (p *GitUploadPack) peeled(ref string) string {
+	if commit, ok := p.tags[ref]; ok {
+		return commit
+	}
+	return p.refs[ref]
+}
+
+// The commits (and tag objects) of every ref String() would write.
+func (p *GitUploadPack) advertisedCommits() map[string]bool {
+	out := make(map[string]bool)
 	for ref, commit := range p.refs {
-		if strings.HasPrefix(commit, commitish) || strings.HasSuffix(ref, commitish) {
-			return nil, commit
+		if p.advertised(ref) {
+			out[commit] = true
+			out[p.peeled(ref)] = true
 		}
 	}
+	return out
+}
+
+var ErrCommitishNotFound = errors.New("Commitish not found")
 
-	return errors.New("Commitish not found"), ""
+// Returned when a commitish matches several refs pointing at different commits.
+type AmbiguousCommitishError struct {
+	Commitish  string
+	Candidates []string // "SHA ref", sorted by ref
 }
 
+func (e *AmbiguousCommitishError) Error() string {
+	return fmt.Sprintf(
+		"Ambiguous commitish '%v', candidates:\n\t%v",
+		e.Commitish, strings.Join(e.Candidates, "\n\t"),
+	)
+}
+
+// Resolve a commitish to a commit, never an annotated tag object. In order of
+// precedence, it can be:
+//
+//   - HEAD or a full ref name, ex. "refs/pull/1/head"
+//   - An exact tag or branch name (tags win)
+//   - A full 40-character SHA, which is returned as is
+//   - A semver range, resolved to the highest matching tag
+//   - A unique prefix (at least 4 characters) of an advertised SHA
+func (p *GitUploadPack) findCommitish(commitish string) (error, string) {
+	_, commit, err := p.findRef(commitish)
+	return err, commit
+}
+
+// Like findCommitish, but also returns the name of the matched ref. It is
+// empty if commitish is a full SHA.
+func (p *GitUploadPack) findRef(commitish string) (string, string, error) {
+	if commitish == "" {
+		return "", "", ErrCommitishNotFound
+	}
+
+	// Exact refs, tags and branches
+	for _, ref := range []string{commitish, "refs/tags/" + commitish, "refs/heads/" + commitish} {
+		if ref != "HEAD" && !strings.HasPrefix(ref, "refs/") {
+			continue
+		}
+		if _, ok := p.refs[ref]; ok {
+			return ref, p.peeled(ref), nil
+		}
+	}
+
+	// If it is a commit-ID, we should just return that, unless it is a tag
+	if len(commitish) == 40 && isHex(commitish) {
+		commitish = strings.ToLower(commitish)
+		for ref, object := range p.refs {
+			if object == commitish {
+				return "", p.peeled(ref), nil
+			}
+		}
+		return "", commitish, nil
+	}
+
+	// Semver ranges, ex. "v1", "^1.2.0" or ">=1.0 <2"
+	if c, err := ParseConstraint(commitish); err == nil {
+		if ref, commit, ok := p.findVersion(c); ok {
+			return ref, commit, nil
+		}
+	}
+
+	// Abbreviated SHAs
+	if len(commitish) < 4 || !isHex(commitish) {
+		return "", "", ErrCommitishNotFound
+	}
+
+	commitish = strings.ToLower(commitish)
+	refs := []string{}
+	commits := map[string]bool{}
+	for ref, object := range p.refs {
+		if strings.HasPrefix(object, commitish) || strings.HasPrefix(p.peeled(ref), commitish) {
+			refs = append(refs, ref)
+			commits[p.peeled(ref)] = true
+		}
+	}
+
+	switch len(commits) {
+	case 0:
+		return "", "", ErrCommitishNotFound
+	case 1:
+		sort.Strings(refs)
+		return refs[0], p.peeled(refs[0]), nil
+	}
+
+	sort.Strings(refs)
+	candidates := make([]string, len(refs))
+	for i, ref := range refs {
+		candidates[i] = fmt.Sprintf("%s %s", p.peeled(ref), ref)
+	}
+	return "", "", &AmbiguousCommitishError{Commitish: commitish, Candidates: candidates}
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Describe what SetMaster pinned to, ex. "v1.2.3 (abc1234)". Empty if nothing
+// was pinned.
+func (p *GitUploadPack) PinnedTo() string {
+	if p.pinnedCommitish == "" {
+		return ""
+	}
+	commit := p.refs["HEAD"]
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	return fmt.Sprintf("%s (%s)", p.pinnedCommitish, commit)
+}
+
+// The branch HEAD points to. Taken from the symref capability if upstream
+// sends it, otherwise guessed from the branches sharing HEAD's commit.
+func (p *GitUploadPack) defaultBranch() string {
+	for _, c := range strings.Fields(p.capabilities) {
+		if strings.HasPrefix(c, "symref=HEAD:") {
+			return strings.TrimPrefix(c, "symref=HEAD:")
+		}
+	}
+
+	head, ok := p.refs["HEAD"]
+	if !ok {
+		return "refs/heads/master"
+	}
+	for _, ref := range []string{"refs/heads/master", "refs/heads/main"} {
+		if p.refs[ref] == head {
+			return ref
+		}
+	}
+	branches := []string{}
+	for ref, commit := range p.refs {
+		if strings.HasPrefix(ref, "refs/heads/") && commit == head {
+			branches = append(branches, ref)
+		}
+	}
+	if len(branches) == 0 {
+		return "refs/heads/master"
+	}
+	sort.Strings(branches)
+	return branches[0]
+}
+
+// Pin the repository to the given commitish: HEAD and the default branch
+// (whatever upstream calls it) are pointed at the resolved commit, so a
+// symref=HEAD:<branch> capability stays valid. Branches never point at
+// annotated tag objects, only at the commits they peel to. An empty commitish
+// leaves everything as upstream advertised it.
 func (p *GitUploadPack) SetMaster(commitish string) error {
-	err, commit := p.findCommitish(commitish)
+	if commitish == "" {
+		return nil
+	}
+	ref, commit, err := p.findRef(commitish)
 	if err != nil {
 		return err
 	}
-	p.refs["refs/heads/master"] = commit
+
+	branch := p.defaultBranch()
+	p.refs["HEAD"] = commit
+	p.refs[branch] = commit
+	p.branch = branch
+	p.pinnedCommitish = commitish
+	p.pinnedRef = ""
+	if strings.HasPrefix(ref, "refs/tags/") {
+		p.pinnedRef = ref
+	}
 	return nil
 }
+
+// Find the highest tag satisfying the given semver constraint. Returns the ref
+// name and the commit.
+func (p *GitUploadPack) findVersion(c *Constraint) (string, string, bool) {
+	var bestRef string
+	var best *Version
+
+	for ref := range p.refs {
+		if !strings.HasPrefix(ref, "refs/tags/") {
+			continue
+		}
+		v, err := ParseVersion(strings.TrimPrefix(ref, "refs/tags/"))
+		if err != nil || !c.Check(v) {
+			continue
+		}
+		if best == nil || v.Compare(best) > 0 || (v.Compare(best) == 0 && ref < bestRef) {
+			best, bestRef = v, ref
+		}
+	}
+
+	if best == nil {
+		return "", "", false
+	}
+	return bestRef, p.peeled(bestRef), true
+}
+
+// Point the pinned tag, HEAD and the default branch at another commit, ex.
+// the one the tag pointed to before it was moved upstream.
+func (p *GitUploadPack) repinTag(commit string) {
+	if p.pinnedRef == "" || p.peeled(p.pinnedRef) == commit {
+		return
+	}
+	p.refs[p.pinnedRef] = commit
+	delete(p.tags, p.pinnedRef)
+	p.refs["HEAD"] = commit
+	p.refs[p.branch] = commit
+}
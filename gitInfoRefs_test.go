@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"strings"
 	"testing"
@@ -27,22 +28,10 @@ func TestGitInfoRefs(t *testing.T) {
 		t.Fatalf("Failed parding git-upload-pack: %v", err)
 	}
 
-	// Stringification spits something similar back out...
-	if len(example) != len(gup.String()) {
-		t.Errorf(
-			"Stringified doc should be length %v, got %v",
-			len(example), len(gup.String()),
-		)
-		t.Errorf(
-			"Expected String() to return \n%v\nGot:\n%v",
-			example, gup.String(),
-		)
+	// Stringification spits the exact same thing back out
+	if gup.String() != example {
+		t.Errorf("Expected String() to return \n%q\nGot:\n%q", example, gup.String())
 	}
-	/*
-		if gup.String() != "001e# service=git-upload-pack\n0000" {
-			t.Errorf("Didn't get the right output.")
-		}
-	*/
 
 	if gup.capabilities != "multi_ack thin-pack side-band side-band-64k ofs-delta shallow no-progress include-tag multi_ack_detailed no-done agent=git/1.8.4" {
 		t.Errorf(
@@ -70,6 +59,10 @@ func TestGitInfoRefs(t *testing.T) {
 		{"update-docs", "48da4910b78e24d8d3a831839cc751700ddc6e10"},
 		{"9b36b682", "9b36b682ebbd7bd224b621fb90864821726b11b3"},
 		{"1111111111111111111111111111111111111111", "1111111111111111111111111111111111111111"},
+		{"0.2", "d58c4a91450924a963d2cc7407dfa3e38866cb06"},
+		{"refs/pull/1/head", "e2f04208620f3bc9d01cc3fb216b92fa4e4a5767"},
+		{"HEAD", "c7d3d3371baa35587fb66d8a79c6d999a4dafd8e"},
+		{"c7d3", "c7d3d3371baa35587fb66d8a79c6d999a4dafd8e"},
 	}
 
 	for _, tt := range tests {
@@ -79,6 +72,13 @@ func TestGitInfoRefs(t *testing.T) {
 		}
 	}
 
+	// Suffixes and too short prefixes are not enough
+	for _, q := range []string{"docs", "1/head", "9b3", ""} {
+		if err, commit := gup.findCommitish(q); err != ErrCommitishNotFound {
+			t.Errorf("Expected '%v' not to be found, got %v and commit %v.", q, err, commit)
+		}
+	}
+
 	// Set commit at someting bogus blows up
 	err = gup.SetMaster("does-not-exist")
 	if err == nil {
@@ -510,6 +510,10 @@ func TestLitmus(t *testing.T) {
 		t.Fatalf("Got unexpected error: %v", err)
 	}
 
+	if g.String() != in {
+		t.Errorf("Expected String() to round-trip the advertisement, got\n%q", g.String())
+	}
+
 	if g.capabilities != "multi_ack thin-pack side-band side-band-64k ofs-delta shallow no-progress include-tag multi_ack_detailed no-done agent=git/1.8.4" {
 		t.Errorf(
 			"Expected capabilities to be \n\t%v\nGot:\n\t%v",
@@ -518,8 +522,191 @@ func TestLitmus(t *testing.T) {
 		)
 	}
 
-	if len(g.refs) != 401 {
-		t.Errorf("Expected 401 refs, got %v", len(g.refs))
+	if len(g.refs) != 399 || len(g.tags) != 2 {
+		t.Errorf("Expected 399 refs and 2 peeled tags, got %v and %v", len(g.refs), len(g.tags))
 	}
 
+	// Semver ranges pick the highest matching tag; exact names win
+	var tests = []struct {
+		q string
+		c string
+	}{
+		{"0", "20ca21a3f7122cf7caa91cb0e9b9c69be9279950"},
+		{"v0.1.1", "7b289043c7beced434be4334fb909ba0b16b57b1"},
+		{"v0.1", "e77b9aa020a2041a0f88459a4d82f236517dff09"},
+		{"v0.x", "e77b9aa020a2041a0f88459a4d82f236517dff09"},
+		{"^0.1.0", "e77b9aa020a2041a0f88459a4d82f236517dff09"},
+		{"~0.1.0", "e77b9aa020a2041a0f88459a4d82f236517dff09"},
+		{"<0.1.2", "7b289043c7beced434be4334fb909ba0b16b57b1"},
+		{">=0.1.0 <0.1.2", "7b289043c7beced434be4334fb909ba0b16b57b1"},
+		{">=0.2.0-rc0", "088a01f19cda4818716c5a2b6a216752ca8825e4"},
+	}
+
+	for _, tt := range tests {
+		err, commit := g.findCommitish(tt.q)
+		if err != nil || commit != tt.c {
+			t.Errorf("Expected '%v' to resolve to %v; got %v and commit %v.", tt.q, tt.c, err, commit)
+		}
+	}
+
+	// Abbreviated SHAs must be unique
+	err, _ = g.findCommitish("3be4")
+	if amb, ok := err.(*AmbiguousCommitishError); !ok {
+		t.Errorf("Expected '3be4' to be ambiguous, got %v", err)
+	} else if len(amb.Candidates) != 2 ||
+		amb.Candidates[0] != "3be470d468b03c1a8536501b6d6c3dd31a709a1b refs/pull/114/merge" ||
+		amb.Candidates[1] != "3be4a751350ef9b46cf491a2151af3255b86bb8a refs/pull/204/head" {
+		t.Errorf("Unexpected candidates for '3be4': %v", amb.Candidates)
+	}
+
+}
+
+func TestSetMasterDefaultBranch(t *testing.T) {
+	var tests = []struct {
+		caps   string
+		branch string
+	}{
+		{"multi_ack symref=HEAD:refs/heads/main agent=git/2.30.0", "refs/heads/main"},
+		{"multi_ack agent=git/2.30.0", "refs/heads/develop"},
+	}
+
+	for _, tt := range tests {
+		in := "001e# service=git-upload-pack\n0000" +
+			writePktLine("c7d3d3371baa35587fb66d8a79c6d999a4dafd8e HEAD\000"+tt.caps+"\n") +
+			writePktLine(fmt.Sprintf("c7d3d3371baa35587fb66d8a79c6d999a4dafd8e %s\n", tt.branch)) +
+			writePktLine("48da4910b78e24d8d3a831839cc751700ddc6e10 refs/tags/v1.0.0\n") +
+			"0000"
+
+		g, err := parseGitUploadPack(ioutil.NopCloser(strings.NewReader(in)))
+		if err != nil {
+			t.Fatalf("Got unexpected error: %v", err)
+		}
+
+		if err := g.SetMaster("v1"); err != nil {
+			t.Fatalf("SetMaster(v1) failed: %v", err)
+		}
+
+		for _, ref := range []string{"HEAD", tt.branch} {
+			if g.refs[ref] != "48da4910b78e24d8d3a831839cc751700ddc6e10" {
+				t.Errorf("Expected %v to be pinned, got %v", ref, g.refs[ref])
+			}
+		}
+		if _, ok := g.refs["refs/heads/master"]; ok {
+			t.Errorf("Did not expect refs/heads/master to be created for %v", tt.branch)
+		}
+		if g.capabilities != tt.caps {
+			t.Errorf("Expected capabilities %v, got %v", tt.caps, g.capabilities)
+		}
+		if !strings.Contains(g.String(), "48da4910b78e24d8d3a831839cc751700ddc6e10 HEAD\000") {
+			t.Errorf("Expected HEAD to be pinned in\n%v", g.String())
+		}
+	}
+}
+
+func TestOnlyPinned(t *testing.T) {
+	in := "001e# service=git-upload-pack\n0000" +
+		writePktLine("c7d3d3371baa35587fb66d8a79c6d999a4dafd8e HEAD\000multi_ack symref=HEAD:refs/heads/main\n") +
+		writePktLine("c7d3d3371baa35587fb66d8a79c6d999a4dafd8e refs/heads/main\n") +
+		writePktLine("d58c4a91450924a963d2cc7407dfa3e38866cb06 refs/heads/0.2\n") +
+		writePktLine("e2f04208620f3bc9d01cc3fb216b92fa4e4a5767 refs/pull/1/head\n") +
+		writePktLine("5589b6faabc822255c87b096c57afaef9fa47d6f refs/tags/v0.1.2\n") +
+		writePktLine("e77b9aa020a2041a0f88459a4d82f236517dff09 refs/tags/v0.1.2^{}\n") +
+		writePktLine("7b289043c7beced434be4334fb909ba0b16b57b1 refs/tags/v0.1.1\n") +
+		"0000"
+
+	g, err := parseGitUploadPack(ioutil.NopCloser(strings.NewReader(in)))
+	if err != nil {
+		t.Fatalf("Got unexpected error: %v", err)
+	}
+	g.OnlyPinned = true
+
+	// Nothing is hidden until a version is pinned
+	if strings.Count(g.String(), "\n") != 8 {
+		t.Errorf("Expected all refs before pinning, got\n%v", g.String())
+	}
+
+	if err := g.SetMaster("v0.1.2"); err != nil {
+		t.Fatalf("SetMaster(v0.1.2) failed: %v", err)
+	}
+
+	out := g.String()
+	for _, ref := range []string{" HEAD\000", " refs/heads/main\n", " refs/tags/v0.1.2\n", " refs/tags/v0.1.2^{}\n"} {
+		if !strings.Contains(out, ref) {
+			t.Errorf("Expected %q to be advertised in\n%v", ref, out)
+		}
+	}
+	for _, ref := range []string{"refs/heads/0.2", "refs/pull/1/head", "refs/tags/v0.1.1"} {
+		if strings.Contains(out, ref) {
+			t.Errorf("Expected %v to be hidden in\n%v", ref, out)
+		}
+	}
+}
+
+func TestSetMasterPeelsTags(t *testing.T) {
+	in := "001e# service=git-upload-pack\n0000" +
+		writePktLine("c7d3d3371baa35587fb66d8a79c6d999a4dafd8e HEAD\000multi_ack symref=HEAD:refs/heads/main\n") +
+		writePktLine("c7d3d3371baa35587fb66d8a79c6d999a4dafd8e refs/heads/main\n") +
+		writePktLine("5589b6faabc822255c87b096c57afaef9fa47d6f refs/tags/v0.1.2\n") +
+		writePktLine("e77b9aa020a2041a0f88459a4d82f236517dff09 refs/tags/v0.1.2^{}\n") +
+		"0000"
+
+	// By name, range, tag object or peeled commit
+	for _, commitish := range []string{"v0.1.2", "v0.1", "5589b6faabc822255c87b096c57afaef9fa47d6f", "5589b6fa", "e77b9aa0"} {
+		g, err := parseGitUploadPack(ioutil.NopCloser(strings.NewReader(in)))
+		if err != nil {
+			t.Fatalf("Got unexpected error: %v", err)
+		}
+		if err := g.SetMaster(commitish); err != nil {
+			t.Fatalf("SetMaster(%v) failed: %v", commitish, err)
+		}
+
+		for _, ref := range []string{"HEAD", "refs/heads/main"} {
+			if g.refs[ref] != "e77b9aa020a2041a0f88459a4d82f236517dff09" {
+				t.Errorf("SetMaster(%v): Expected %v at the peeled commit, got %v", commitish, ref, g.refs[ref])
+			}
+		}
+
+		// The tag still points at the tag object, with the peeled line right after
+		exp := writePktLine("5589b6faabc822255c87b096c57afaef9fa47d6f refs/tags/v0.1.2\n") +
+			writePktLine("e77b9aa020a2041a0f88459a4d82f236517dff09 refs/tags/v0.1.2^{}\n")
+		if !strings.Contains(g.String(), exp) {
+			t.Errorf("SetMaster(%v): Expected peeled tag in\n%v", commitish, g.String())
+		}
+	}
+}
+
+func TestGitInfoRefsRoundTrip(t *testing.T) {
+	var tests = []string{
+		// Unsorted, as upstream sent it
+		"001e# service=git-upload-pack\n0000" +
+			writePktLine("c7d3d3371baa35587fb66d8a79c6d999a4dafd8e HEAD\000multi_ack symref=HEAD:refs/heads/main\n") +
+			writePktLine("c7d3d3371baa35587fb66d8a79c6d999a4dafd8e refs/heads/main\n") +
+			writePktLine("d58c4a91450924a963d2cc7407dfa3e38866cb06 refs/heads/0.2\n") +
+			writePktLine("5589b6faabc822255c87b096c57afaef9fa47d6f refs/tags/v0.1.2\n") +
+			writePktLine("e77b9aa020a2041a0f88459a4d82f236517dff09 refs/tags/v0.1.2^{}\n") +
+			writePktLine("7b289043c7beced434be4334fb909ba0b16b57b1 refs/tags/v0.1.1\n") +
+			"0000",
+		// Protocol v1, without newlines
+		"001e# service=git-upload-pack\n0000" +
+			writePktLine("version 1\n") +
+			writePktLine("c7d3d3371baa35587fb66d8a79c6d999a4dafd8e HEAD\000multi_ack") +
+			writePktLine("c7d3d3371baa35587fb66d8a79c6d999a4dafd8e refs/heads/master") +
+			"0000",
+		// An empty repository
+		"001e# service=git-upload-pack\n0000" +
+			writePktLine("0000000000000000000000000000000000000000 capabilities^{}\000multi_ack agent=git/2.30.0\n") +
+			"0000",
+	}
+
+	for _, in := range tests {
+		g, err := parseGitUploadPack(ioutil.NopCloser(strings.NewReader(in)))
+		if err != nil {
+			t.Fatalf("Got unexpected error: %v", err)
+		}
+		for i := 0; i < 3; i++ {
+			if got := g.String(); got != in {
+				t.Errorf("Expected String() to return\n%q\nGot\n%q", in, got)
+			}
+		}
+	}
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A local bare git repository, driven through the git command line.
+type localRepo struct {
+	dir string
+	// Removed once used, see Remove().
+	temporary bool
+	// Added to the environment of git commands, ex. for credentials.
+	env []string
+	// What upstream git may connect to; nil for no restrictions.
+	policy *UpstreamPolicy
+}
+
+// Run git in the repository, returning its standard output.
+func (l *localRepo) git(args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = l.dir
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), l.env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		name := args[0]
+		for i := 0; i+2 < len(args) && args[i] == "-c"; i += 2 {
+			name = args[i+2]
+		}
+		return nil, fmt.Errorf("git %v: %v: %v", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Run git talking to the given upstream repository. Redirects are not
+// followed, as the upstream policy has not checked where they lead, and git
+// connects to the address the policy checked instead of looking the name up
+// again.
+func (l *localRepo) gitUpstream(repoUrl string, args ...string) ([]byte, error) {
+	config := []string{"-c", "http.followRedirects=false"}
+	resolve, err := l.policy.gitResolve(repoUrl)
+	if err != nil {
+		return nil, err
+	} else if resolve != "" {
+		config = append(config, "-c", "http.curloptResolve="+resolve)
+	}
+	return l.git(append(config, args...)...)
+}
+
+// Fetch a single commit from upstream into a new temporary repository. The
+// caller must Remove() it when done.
+func fetchCommit(repoUrl, commit string, credentials *Credentials, policy *UpstreamPolicy) (*localRepo, error) {
+	dir, err := ioutil.TempDir("", "git-version-proxy")
+	if err != nil {
+		return nil, err
+	}
+	l := &localRepo{dir: dir, temporary: true, env: credentials.gitEnv(repoUrl), policy: policy}
+
+	if _, err := l.git("init", "--quiet", "--bare"); err != nil {
+		l.Remove()
+		return nil, err
+	}
+	if _, err := l.gitUpstream(repoUrl, "fetch", "--quiet", "--depth=1", repoUrl, commit); err != nil {
+		l.Remove()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Fetch the history of all branches and tags from upstream into a new
+// temporary repository, for finding commits no ref points at. The caller must
+// Remove() it when done.
+func fetchHistory(repoUrl string, credentials *Credentials, policy *UpstreamPolicy) (*localRepo, error) {
+	dir, err := ioutil.TempDir("", "git-version-proxy")
+	if err != nil {
+		return nil, err
+	}
+	l := &localRepo{dir: dir, temporary: true, env: credentials.gitEnv(repoUrl), policy: policy}
+
+	if _, err := l.git("init", "--quiet", "--bare"); err != nil {
+		l.Remove()
+		return nil, err
+	}
+	if _, err := l.gitUpstream(repoUrl, "fetch", "--quiet", repoUrl, "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"); err != nil {
+		l.Remove()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Remove a temporary repository; mirrors are left alone.
+func (l *localRepo) Remove() error {
+	if !l.temporary {
+		return nil
+	}
+	return os.RemoveAll(l.dir)
+}
+
+// The full SHA of a commit, given an abbreviated one.
+func (l *localRepo) resolveCommit(abbrev string) (string, error) {
+	out, err := l.git("rev-parse", "--verify", "--quiet", abbrev+"^{commit}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Does the repository have the given object?
+func (l *localRepo) has(object string) bool {
+	_, err := l.git("cat-file", "-e", object)
+	return err == nil
+}
+
+// The committer time of a commit.
+func (l *localRepo) commitTime(commit string) (time.Time, error) {
+	out, err := l.git("log", "-1", "--format=%ct", commit)
+	if err != nil {
+		return time.Time{}, err
+	}
+	secs, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
+
+// Read a file at the given commit. Returns os.ErrNotExist if it is not there.
+func (l *localRepo) readFile(commit, path string) ([]byte, error) {
+	if !l.has(fmt.Sprintf("%s:%s", commit, path)) {
+		return nil, os.ErrNotExist
+	}
+	return l.git("cat-file", "blob", fmt.Sprintf("%s:%s", commit, path))
+}
+
+// The tree of a commit as a tar archive.
+func (l *localRepo) archive(commit string) (io.Reader, error) {
+	out, err := l.git("archive", "--format=tar", commit)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(out), nil
+}
+
+// Run git upload-pack in stateless RPC mode, as used for smart HTTP. With
+// advertise, it lists the refs; otherwise it answers the request on stdin.
+// The protocol is the client's Git-Protocol header. stdinClosers, such as the
+// request body stdin is read from, are closed once git is done with stdin.
+func (l *localRepo) uploadPack(protocol string, advertise bool, stdin io.Reader, stdinClosers ...io.Closer) (io.ReadCloser, error) {
+	args := []string{"upload-pack", "--stateless-rpc"}
+	if advertise {
+		args = append(args, "--advertise-refs")
+	}
+	cmd := exec.Command("git", append(args, ".")...)
+	cmd.Dir = l.dir
+	cmd.Env = append(os.Environ(), "GIT_PROTOCOL="+protocol)
+	cmd.Stdin = stdin
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out := &commandOutput{cmd: cmd, stderr: &stderr, stdinClosers: stdinClosers}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		out.closeStdin()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		out.closeStdin()
+		return nil, err
+	}
+	out.ReadCloser = stdout
+	return out, nil
+}
+
+// The output of a running command; closing it waits for the command.
+type commandOutput struct {
+	io.ReadCloser
+	cmd          *exec.Cmd
+	stderr       *bytes.Buffer
+	stdinClosers []io.Closer
+}
+
+func (c *commandOutput) Close() error {
+	// If it has not all been read, the command dies from a broken pipe
+	c.ReadCloser.Close()
+	// Only once it is done may stdin be closed, as exec may still be copying it
+	defer c.closeStdin()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("git %v: %v: %v", c.cmd.Args[1], err, strings.TrimSpace(c.stderr.String()))
+	}
+	return nil
+}
+
+func (c *commandOutput) closeStdin() {
+	for _, closer := range c.stdinClosers {
+		closer.Close()
+	}
+}
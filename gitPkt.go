@@ -1,54 +1,160 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
 )
 
-func readPktLine(r io.ReadCloser) ([]string, error) {
-	defer r.Close()
-	out := []string{}
-	offsetBytes := make([]byte, 4)
-	for {
-		// Get and parse offset
-		_, err := r.Read(offsetBytes)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-		offset, _ := strconv.ParseUint(string(offsetBytes), 16, 16)
-		if offset == 0 {
-			out = append(out, "")
-			continue
-		}
-		//if (offsetBytes == []byte{0, 0, 0, 4}) { continue }
+// Largest pkt-line allowed, including the four length bytes.
+const MaxPktLen = 65520
+
+type PktType int
+
+const (
+	PktData        PktType = iota
+	PktFlush               // 0000
+	PktDelim               // 0001, separates sections in protocol v2
+	PktResponseEnd         // 0002, ends a stateless protocol v2 response
+)
+
+// A single pkt-line. Data holds the payload exactly as sent (including any
+// trailing newline) and is empty for the special packets.
+type Pkt struct {
+	Type PktType
+	Data []byte
+}
+
+// Reads one pkt-line at a time from an underlying stream.
+type PktReader struct {
+	r      io.Reader
+	length [4]byte
+}
+
+func NewPktReader(r io.Reader) *PktReader {
+	return &PktReader{r: r}
+}
+
+// Read the next packet. Returns io.EOF if the stream ends cleanly between
+// packets and io.ErrUnexpectedEOF if it ends inside one.
+func (r *PktReader) ReadPkt() (Pkt, error) {
+	if _, err := io.ReadFull(r.r, r.length[:]); err != nil {
+		return Pkt{}, err
+	}
+
+	length, err := strconv.ParseUint(string(r.length[:]), 16, 16)
+	if err != nil {
+		return Pkt{}, fmt.Errorf("PktReader: Invalid length '%s'", r.length[:])
+	}
+
+	switch {
+	case length == 0:
+		return Pkt{Type: PktFlush}, nil
+	case length == 1:
+		return Pkt{Type: PktDelim}, nil
+	case length == 2:
+		return Pkt{Type: PktResponseEnd}, nil
+	case length < 4:
+		return Pkt{}, fmt.Errorf("PktReader: Invalid length '%s'", r.length[:])
+	case length > MaxPktLen:
+		return Pkt{}, fmt.Errorf("PktReader: Packet of %v bytes exceeds %v", length, MaxPktLen)
+	}
+
+	data := make([]byte, length-4)
+	if _, err := io.ReadFull(r.r, data); err == io.EOF {
+		return Pkt{}, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return Pkt{}, err
+	}
+	return Pkt{Type: PktData, Data: data}, nil
+}
+
+var ErrPktTooLong = errors.New("PktWriter: Packet too long")
 
-		// Read remainer
-		rest := make([]byte, offset-4)
-		_, err = r.Read(rest)
+// Writes pkt-lines to an underlying stream.
+type PktWriter struct {
+	w io.Writer
+}
+
+func NewPktWriter(w io.Writer) *PktWriter {
+	return &PktWriter{w: w}
+}
+
+// Write data as a single packet.
+func (w *PktWriter) WritePkt(data []byte) error {
+	if len(data)+4 > MaxPktLen {
+		return ErrPktTooLong
+	}
+	if _, err := fmt.Fprintf(w.w, "%04x", len(data)+4); err != nil {
+		return err
+	}
+	_, err := w.w.Write(data)
+	return err
+}
+
+// Write a packet as read by a PktReader.
+func (w *PktWriter) WritePacket(pkt Pkt) error {
+	switch pkt.Type {
+	case PktFlush:
+		return w.Flush()
+	case PktDelim:
+		return w.Delim()
+	case PktResponseEnd:
+		return w.ResponseEnd()
+	}
+	return w.WritePkt(pkt.Data)
+}
+
+func (w *PktWriter) WriteString(s string) error {
+	return w.WritePkt([]byte(s))
+}
+
+func (w *PktWriter) Flush() error {
+	_, err := io.WriteString(w.w, "0000")
+	return err
+}
+
+func (w *PktWriter) Delim() error {
+	_, err := io.WriteString(w.w, "0001")
+	return err
+}
+
+func (w *PktWriter) ResponseEnd() error {
+	_, err := io.WriteString(w.w, "0002")
+	return err
+}
+
+// Format a single pkt-line.
+func writePktLine(line string) string {
+	return fmt.Sprintf("%04x%s", len(line)+4, line)
+}
+
+// Read pkt-lines up to the next flush packet, split into sections at each
+// delim packet, as used by protocol v2 commands and responses. Lines have
+// their trailing newline removed. If r ends without a flush, whatever was read
+// is returned along with io.EOF.
+func readPktSections(r *PktReader) ([][]string, error) {
+	sections := [][]string{{}}
+	for {
+		pkt, err := r.ReadPkt()
 		if err == io.EOF {
-			break
-		}
-		if err != nil {
+			return sections, err
+		} else if err != nil {
 			return nil, err
 		}
-		out = append(out, strings.TrimSpace(string(rest)))
-	}
-	return out, nil
-}
 
-func writePktLines(w io.Writer, d []string) error {
-	for _, line := range d {
-		if len(line) == 0 {
-			fmt.Fprintf(w, "0000")
-			continue
+		switch pkt.Type {
+		case PktFlush:
+			return sections, nil
+		case PktDelim:
+			sections = append(sections, []string{})
+		case PktData:
+			last := len(sections) - 1
+			sections[last] = append(sections[last], strings.TrimSuffix(string(pkt.Data), "\n"))
+		default:
+			return nil, fmt.Errorf("PktLine: Unexpected response-end packet")
 		}
-		//fmt.Printf("Encoding: %04x%s\n", len(line)+4, line)
-		fmt.Fprintf(w, "%04x%s", len(line)+4, line)
 	}
-	return nil
 }
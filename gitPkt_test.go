@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestPktReader(t *testing.T) {
+	in := "000ahello\n" + "0000" + "0001" + "0002" + "0004" + "0008\x00\x01 \n"
+
+	// Reading one byte at a time must not break packets apart
+	r := NewPktReader(iotest.OneByteReader(strings.NewReader(in)))
+
+	var exp = []Pkt{
+		{PktData, []byte("hello\n")},
+		{PktFlush, nil},
+		{PktDelim, nil},
+		{PktResponseEnd, nil},
+		{PktData, []byte{}},
+		{PktData, []byte("\x00\x01 \n")},
+	}
+
+	for i, e := range exp {
+		pkt, err := r.ReadPkt()
+		if err != nil {
+			t.Fatalf("Packet %v: Unexpected error %v", i, err)
+		}
+		if pkt.Type != e.Type || !bytes.Equal(pkt.Data, e.Data) {
+			t.Errorf("Packet %v: Expected %v %q, got %v %q", i, e.Type, e.Data, pkt.Type, pkt.Data)
+		}
+	}
+
+	if _, err := r.ReadPkt(); err != io.EOF {
+		t.Errorf("Expected io.EOF at end of input, got %v", err)
+	}
+}
+
+func TestPktReaderErrors(t *testing.T) {
+	var tests = []struct {
+		in  string
+		err string
+	}{
+		{"zzzz", "Invalid length"},
+		{"0003", "Invalid length"},
+		{"fff1" + strings.Repeat("x", 0xfff1-4), "exceeds"},
+		{"000ahel", "unexpected EOF"},
+		{"00", "unexpected EOF"},
+	}
+
+	for _, tt := range tests {
+		_, err := NewPktReader(strings.NewReader(tt.in)).ReadPkt()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Expected %q to fail with '%v', got %v", tt.in[:4], tt.err, err)
+		}
+	}
+}
+
+func TestPktWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewPktWriter(&buf)
+
+	w.WriteString("hello\n")
+	w.Flush()
+	w.Delim()
+	w.WritePkt([]byte{0, 1, 2})
+	w.ResponseEnd()
+
+	if exp := "000ahello\n000000010007\x00\x01\x020002"; buf.String() != exp {
+		t.Errorf("Expected %q, got %q", exp, buf.String())
+	}
+
+	if err := w.WritePkt(make([]byte, MaxPktLen-3)); err != ErrPktTooLong {
+		t.Errorf("Expected ErrPktTooLong, got %v", err)
+	}
+	if err := w.WritePkt(make([]byte, MaxPktLen-4)); err != nil {
+		t.Errorf("Expected maximum sized packet to be written, got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Does the client ask for git protocol version 2?
+func wantsProtocolV2(h http.Header) bool {
+	for _, param := range strings.Split(h.Get("Git-Protocol"), ":") {
+		if strings.TrimSpace(param) == "version=2" {
+			return true
+		}
+	}
+	return false
+}
+
+// Is the info/refs response a protocol v2 capability advertisement rather
+// than a v0/v1 ref list? The former has no refs to rewrite.
+func isProtocolV2Advertisement(body []byte) bool {
+	r := NewPktReader(bytes.NewReader(body))
+	// Smart HTTP puts "# service=..." and a flush in front
+	for i := 0; i < 2; i++ {
+		sections, err := readPktSections(r)
+		if err != nil || len(sections) != 1 {
+			return false
+		}
+		for _, line := range sections[0] {
+			if line == "version 2" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A protocol v2 command as sent in a git-upload-pack POST body: the command
+// name, its capability lines and its arguments.
+type gitCommandV2 struct {
+	command      string
+	capabilities []string
+	args         []string
+}
+
+func parseGitCommandV2(r io.Reader) (*gitCommandV2, error) {
+	sections, err := readPktSections(NewPktReader(r))
+	if err != nil {
+		return nil, err
+	}
+	if len(sections) > 2 || len(sections[0]) == 0 || !strings.HasPrefix(sections[0][0], "command=") {
+		return nil, fmt.Errorf("ProtocolV2: Malformed command request")
+	}
+
+	c := &gitCommandV2{
+		command:      strings.TrimPrefix(sections[0][0], "command="),
+		capabilities: sections[0][1:],
+	}
+	if len(sections) == 2 {
+		c.args = sections[1]
+	}
+	return c, nil
+}
+
+func (c *gitCommandV2) hasArg(arg string) bool {
+	for _, a := range c.args {
+		if a == arg {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *gitCommandV2) refPrefixes() []string {
+	out := []string{}
+	for _, a := range c.args {
+		if strings.HasPrefix(a, "ref-prefix ") {
+			out = append(out, strings.TrimPrefix(a, "ref-prefix "))
+		}
+	}
+	return out
+}
+
+func (c *gitCommandV2) String() string {
+	out := []string{writePktLine(fmt.Sprintf("command=%s\n", c.command))}
+	for _, line := range c.capabilities {
+		out = append(out, writePktLine(line+"\n"))
+	}
+	out = append(out, "0001")
+	for _, line := range c.args {
+		out = append(out, writePktLine(line+"\n"))
+	}
+	out = append(out, "0000")
+	return strings.Join(out, "")
+}
+
+// The ls-refs request to send upstream: we need every ref, peeled tags and
+// HEAD's symref to resolve a commitish, whatever the client asked for.
+func (c *gitCommandV2) upstreamLsRefs() *gitCommandV2 {
+	args := []string{"peel", "symrefs"}
+	for _, a := range c.args {
+		if a != "peel" && a != "symrefs" && !strings.HasPrefix(a, "ref-prefix ") {
+			args = append(args, a)
+		}
+	}
+	return &gitCommandV2{command: "ls-refs", capabilities: c.capabilities, args: args}
+}
+
+// Parse an ls-refs response ("SHA ref[ symref-target:ref][ peeled:SHA]"
+// lines) into the same form as a v0 advertisement: HEAD's symref-target
+// becomes a symref capability.
+func parseLsRefs(r io.Reader) (*GitUploadPack, error) {
+	sections, err := readPktSections(NewPktReader(r))
+	if err != nil {
+		return nil, err
+	}
+	if len(sections) != 1 {
+		return nil, fmt.Errorf("ProtocolV2: Unexpected delim in ls-refs response")
+	}
+
+	p := NewGitUploadPack()
+	for _, line := range sections[0] {
+		parts := strings.Split(line, " ")
+		if len(parts) < 2 {
+			return p, fmt.Errorf("ProtocolV2: Unexpected ls-refs line '%v'", line)
+		}
+		// Empty repositories only have an unborn HEAD; nothing to pin
+		if parts[0] == "unborn" {
+			continue
+		}
+		if len(parts[0]) != 40 {
+			return p, fmt.Errorf("ProtocolV2: Unexpected ls-refs line '%v'", line)
+		}
+
+		ref := parts[1]
+		p.refs[ref] = parts[0]
+		p.order = append(p.order, ref)
+		for _, attr := range parts[2:] {
+			switch {
+			case strings.HasPrefix(attr, "peeled:"):
+				p.tags[ref] = strings.TrimPrefix(attr, "peeled:")
+			case strings.HasPrefix(attr, "symref-target:") && ref == "HEAD":
+				p.capabilities = "symref=HEAD:" + strings.TrimPrefix(attr, "symref-target:")
+			}
+		}
+	}
+	return p, nil
+}
+
+// Write the refs as an ls-refs response to the given request, honoring its
+// ref-prefix, peel and symrefs arguments.
+func (p *GitUploadPack) LsRefs(c *gitCommandV2) string {
+	prefixes := c.refPrefixes()
+	matches := func(ref string) bool {
+		if len(prefixes) == 0 {
+			return true
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(ref, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	out := []string{}
+	for _, ref := range p.orderedRefs() {
+		if !matches(ref) || !p.advertised(ref) {
+			continue
+		}
+		line := fmt.Sprintf("%s %s", p.refs[ref], ref)
+		if ref == "HEAD" && c.hasArg("symrefs") && strings.Contains(p.capabilities, "symref=HEAD:") {
+			line += " symref-target:" + p.defaultBranch()
+		}
+		if peeled, ok := p.tags[ref]; ok && c.hasArg("peel") {
+			line += " peeled:" + peeled
+		}
+		out = append(out, writePktLine(line+"\n"))
+	}
+	out = append(out, "0000")
+
+	return strings.Join(out, "")
+}
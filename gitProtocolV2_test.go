@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var testLsRefsResponse = writePktLine("c7d3d3371baa35587fb66d8a79c6d999a4dafd8e HEAD symref-target:refs/heads/main\n") +
+	writePktLine("c7d3d3371baa35587fb66d8a79c6d999a4dafd8e refs/heads/main\n") +
+	writePktLine("d58c4a91450924a963d2cc7407dfa3e38866cb06 refs/heads/0.2\n") +
+	writePktLine("5589b6faabc822255c87b096c57afaef9fa47d6f refs/tags/v0.1.2 peeled:e77b9aa020a2041a0f88459a4d82f236517dff09\n") +
+	writePktLine("7b289043c7beced434be4334fb909ba0b16b57b1 refs/tags/v0.1.1\n") +
+	"0000"
+
+func TestIsProtocolV2Advertisement(t *testing.T) {
+	v2 := "001e# service=git-upload-pack\n0000" +
+		writePktLine("version 2\n") +
+		writePktLine("agent=git/github-g1234\n") +
+		writePktLine("ls-refs=unborn\n") +
+		writePktLine("fetch=shallow filter\n") +
+		"0000"
+
+	if !isProtocolV2Advertisement([]byte(v2)) {
+		t.Errorf("Expected v2 advertisement to be detected")
+	}
+	if isProtocolV2Advertisement([]byte(testAdvertisement)) {
+		t.Errorf("Did not expect v0 advertisement to be detected as v2")
+	}
+}
+
+func TestGitCommandV2(t *testing.T) {
+	in := writePktLine("command=ls-refs\n") +
+		writePktLine("agent=git/2.30.0\n") +
+		"0001" +
+		writePktLine("peel\n") +
+		writePktLine("ref-prefix refs/heads/\n") +
+		writePktLine("unborn\n") +
+		"0000"
+
+	c, err := parseGitCommandV2(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("parseGitCommandV2 failed: %v", err)
+	}
+	if c.command != "ls-refs" || len(c.capabilities) != 1 || len(c.args) != 3 {
+		t.Errorf("Unexpected command %+v", c)
+	}
+	if c.String() != in {
+		t.Errorf("Expected command to round-trip, got %q", c.String())
+	}
+
+	exp := writePktLine("command=ls-refs\n") +
+		writePktLine("agent=git/2.30.0\n") +
+		"0001" +
+		writePktLine("peel\n") +
+		writePktLine("symrefs\n") +
+		writePktLine("unborn\n") +
+		"0000"
+	if got := c.upstreamLsRefs().String(); got != exp {
+		t.Errorf("Expected upstream ls-refs\n%q\nGot\n%q", exp, got)
+	}
+}
+
+func TestLsRefs(t *testing.T) {
+	g, err := parseLsRefs(strings.NewReader(testLsRefsResponse))
+	if err != nil {
+		t.Fatalf("parseLsRefs failed: %v", err)
+	}
+
+	if g.tags["refs/tags/v0.1.2"] != "e77b9aa020a2041a0f88459a4d82f236517dff09" {
+		t.Errorf("Expected peeled tag to be parsed, got %v", g.tags)
+	}
+	if g.defaultBranch() != "refs/heads/main" {
+		t.Errorf("Expected default branch refs/heads/main, got %v", g.defaultBranch())
+	}
+
+	if err := g.SetMaster("v0.1.1"); err != nil {
+		t.Fatalf("SetMaster(v0.1.1) failed: %v", err)
+	}
+
+	// In upstream's order
+	c := &gitCommandV2{command: "ls-refs", args: []string{"symrefs", "peel", "ref-prefix HEAD", "ref-prefix refs/tags/"}}
+	exp := writePktLine("7b289043c7beced434be4334fb909ba0b16b57b1 HEAD symref-target:refs/heads/main\n") +
+		writePktLine("5589b6faabc822255c87b096c57afaef9fa47d6f refs/tags/v0.1.2 peeled:e77b9aa020a2041a0f88459a4d82f236517dff09\n") +
+		writePktLine("7b289043c7beced434be4334fb909ba0b16b57b1 refs/tags/v0.1.1\n") +
+		"0000"
+	if got := g.LsRefs(c); got != exp {
+		t.Errorf("Expected ls-refs\n%q\nGot\n%q", exp, got)
+	}
+}
+
+func TestServeGitProtocolV2(t *testing.T) {
+	var upstreamRequest string
+	p, upstream := newTestProxyWithUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		upstreamRequest = string(body)
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+		w.Write([]byte(testLsRefsResponse))
+	}))
+	defer upstream.Close()
+
+	in := writePktLine("command=ls-refs\n") +
+		"0001" +
+		writePktLine("ref-prefix refs/heads/\n") +
+		"0000"
+	req := httptest.NewRequest("POST", "/_git/git.example.com/foo/bar@v0.1.1/git-upload-pack", strings.NewReader(in))
+	req.Header.Set("Git-Protocol", "version=2")
+	w := httptest.NewRecorder()
+	p.Handler().ServeHTTP(w, req)
+
+	if strings.Contains(upstreamRequest, "ref-prefix") || !strings.Contains(upstreamRequest, "symrefs") {
+		t.Errorf("Expected upstream to be asked for all refs, got %q", upstreamRequest)
+	}
+
+	exp := writePktLine("7b289043c7beced434be4334fb909ba0b16b57b1 refs/heads/main\n") +
+		writePktLine("d58c4a91450924a963d2cc7407dfa3e38866cb06 refs/heads/0.2\n") +
+		"0000"
+	if w.Code != 200 || w.Body.String() != exp {
+		t.Errorf("Expected 200 and\n%q\nGot %v and\n%q", exp, w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// What a client asks for in a git-upload-pack POST, in either protocol
+// version.
+type uploadPackRequest struct {
+	wants    []string
+	wantRefs []string // Protocol v2 only
+	haves    []string
+	shallows []string
+	deepen   []string // "deepen", "deepen-since" and "deepen-not" lines
+	done     bool
+
+	// Largest side-band payload the client accepts, 0 if it does not do
+	// side-band, and whether it asked not to get progress messages.
+	sideBandMax int
+	noProgress  bool
+}
+
+// Parse a protocol v0/v1 request: want (and shallow/deepen) lines up to a
+// flush, then have lines and done, possibly over several flushes.
+func parseUploadPackRequest(r io.Reader) (*uploadPackRequest, error) {
+	req := &uploadPackRequest{}
+	pr := NewPktReader(r)
+	for {
+		sections, err := readPktSections(pr)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(sections) != 1 {
+			return nil, fmt.Errorf("UploadPack: Unexpected delim in request")
+		}
+		for _, line := range sections[0] {
+			if err := req.parseLine(line); err != nil {
+				return nil, err
+			}
+		}
+		if err == io.EOF || req.done {
+			break
+		}
+	}
+	return req, nil
+}
+
+// Parse the arguments of a protocol v2 fetch command.
+func parseFetchCommand(c *gitCommandV2) (*uploadPackRequest, error) {
+	// The packfile is always multiplexed in v2
+	req := &uploadPackRequest{sideBandMax: SideBand64kMax}
+	for _, arg := range c.args {
+		if err := req.parseLine(arg); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+func (req *uploadPackRequest) parseLine(line string) error {
+	parts := strings.SplitN(line, " ", 3)
+	switch parts[0] {
+	case "want", "have", "shallow":
+		if len(parts) < 2 || len(parts[1]) != 40 || !isHex(parts[1]) {
+			return fmt.Errorf("UploadPack: Malformed line '%v'", line)
+		}
+		switch parts[0] {
+		case "want":
+			// In v0, the first want carries the client's capabilities
+			if len(req.wants) == 0 && len(parts) == 3 {
+				req.parseCapabilities(strings.Fields(parts[2]))
+			}
+			req.wants = append(req.wants, parts[1])
+		case "have":
+			req.haves = append(req.haves, parts[1])
+		case "shallow":
+			req.shallows = append(req.shallows, parts[1])
+		}
+	case "want-ref":
+		if len(parts) != 2 {
+			return fmt.Errorf("UploadPack: Malformed line '%v'", line)
+		}
+		req.wantRefs = append(req.wantRefs, parts[1])
+	case "deepen", "deepen-since", "deepen-not":
+		req.deepen = append(req.deepen, line)
+	case "done":
+		req.done = true
+	case "no-progress":
+		req.noProgress = true
+	}
+	// Anything else is an argument (thin-pack, ofs-delta, filter, ...) we
+	// do not care about.
+	return nil
+}
+
+func (req *uploadPackRequest) parseCapabilities(caps []string) {
+	for _, c := range caps {
+		switch c {
+		case "side-band":
+			if req.sideBandMax == 0 {
+				req.sideBandMax = SideBandMax
+			}
+		case "side-band-64k":
+			req.sideBandMax = SideBand64kMax
+		case "no-progress":
+			req.noProgress = true
+		}
+	}
+}
+
+// Check that everything the client wants has been advertised to it.
+func (req *uploadPackRequest) validate(p *GitUploadPack) error {
+	commits := p.advertisedCommits()
+	for _, want := range req.wants {
+		if !commits[want] {
+			return fmt.Errorf("want %v not valid: not part of the pinned version", want)
+		}
+	}
+	for _, ref := range req.wantRefs {
+		if _, ok := p.refs[ref]; !ok || !p.advertised(ref) {
+			return fmt.Errorf("want-ref %v not valid: not part of the pinned version", ref)
+		}
+	}
+	return nil
+}
+
+// Parse the body of a git-upload-pack POST. For protocol v2, the command is
+// returned too, and the request is nil unless it is a fetch.
+func parseUploadPackPost(h http.Header, body []byte) (*uploadPackRequest, *gitCommandV2, error) {
+	var r io.Reader = bytes.NewReader(body)
+	if h.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	if !wantsProtocolV2(h) {
+		req, err := parseUploadPackRequest(r)
+		return req, nil, err
+	}
+
+	c, err := parseGitCommandV2(r)
+	if err != nil || c.command != "fetch" {
+		return nil, c, err
+	}
+	req, err := parseFetchCommand(c)
+	return req, c, err
+}
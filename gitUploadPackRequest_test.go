@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseUploadPackPost(t *testing.T) {
+	v0 := writePktLine("want 48da4910b78e24d8d3a831839cc751700ddc6e10 multi_ack side-band-64k ofs-delta\n") +
+		writePktLine("want c7d3d3371baa35587fb66d8a79c6d999a4dafd8e\n") +
+		writePktLine("deepen 1\n") +
+		"0000" +
+		writePktLine("have d58c4a91450924a963d2cc7407dfa3e38866cb06\n") +
+		writePktLine("done\n")
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(v0))
+	zw.Close()
+
+	v2 := writePktLine("command=fetch\n") +
+		writePktLine("agent=git/2.30.0\n") +
+		"0001" +
+		writePktLine("thin-pack\n") +
+		writePktLine("want 48da4910b78e24d8d3a831839cc751700ddc6e10\n") +
+		writePktLine("want c7d3d3371baa35587fb66d8a79c6d999a4dafd8e\n") +
+		writePktLine("have d58c4a91450924a963d2cc7407dfa3e38866cb06\n") +
+		writePktLine("deepen 1\n") +
+		writePktLine("done\n") +
+		"0000"
+
+	var tests = []struct {
+		name   string
+		header http.Header
+		body   []byte
+	}{
+		{"v0", http.Header{}, []byte(v0)},
+		{"v0 gzip", http.Header{"Content-Encoding": {"gzip"}}, gz.Bytes()},
+		{"v2", http.Header{"Git-Protocol": {"version=2"}}, []byte(v2)},
+	}
+
+	for _, tt := range tests {
+		req, _, err := parseUploadPackPost(tt.header, tt.body)
+		if err != nil {
+			t.Errorf("%v: Unexpected error %v", tt.name, err)
+			continue
+		}
+		if len(req.wants) != 2 || req.wants[0] != "48da4910b78e24d8d3a831839cc751700ddc6e10" ||
+			len(req.haves) != 1 || len(req.deepen) != 1 || !req.done {
+			t.Errorf("%v: Unexpected request %+v", tt.name, req)
+		}
+	}
+
+	bad := writePktLine("want 48da4910\n") + "0000"
+	if _, _, err := parseUploadPackPost(http.Header{}, []byte(bad)); err == nil {
+		t.Errorf("Expected malformed want to be rejected")
+	}
+}
+
+func TestServeGitRejectsUnpinnedWants(t *testing.T) {
+	p, upstream := newTestProxy(t, testAdvertisement)
+	defer upstream.Close()
+	p.config.OnlyPinned = true
+
+	var tests = []struct {
+		want string
+		err  bool
+	}{
+		{"c7d3d3371baa35587fb66d8a79c6d999a4dafd8e", false},
+		{"48da4910b78e24d8d3a831839cc751700ddc6e10", true},
+		{"1111111111111111111111111111111111111111", true},
+	}
+
+	for _, tt := range tests {
+		body := writePktLine("want "+tt.want+" side-band-64k\n") + "0000" + writePktLine("done\n")
+		w := httptest.NewRecorder()
+		p.Handler().ServeHTTP(w, httptest.NewRequest(
+			"POST",
+			"/_git/git.example.com/foo/bar@master/git-upload-pack",
+			strings.NewReader(body),
+		))
+
+		res, _ := ioutil.ReadAll(w.Body)
+		if tt.err && !strings.HasPrefix(string(res)[4:], "ERR want "+tt.want) {
+			t.Errorf("Expected want %v to be rejected, got %q", tt.want, res)
+		} else if !tt.err && string(res) != "0008NAK\n" {
+			t.Errorf("Expected want %v to be passed upstream, got %q", tt.want, res)
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Is it a request for the Go module proxy protocol (GOPROXY)?
+func isModuleRequest(path string) bool {
+	return strings.Contains(path, "/@v/") || strings.HasSuffix(path, "/@latest")
+}
+
+// A Go module path split up according to the host registry, ex.
+// "github.com/foo/bar/sub/v2" has repo "foo/bar", subdir "sub" and major "v2".
+type modulePath struct {
+	path   string
+	host   *Host
+	repo   string
+	subdir string
+	major  string
+}
+
+var majorSuffix = regexp.MustCompile(`^v([2-9]|[1-9][0-9]+)$`)
+
+func (p *Proxy) parseModulePath(escaped string) (*modulePath, error) {
+	path, err := unescapeModulePath(escaped)
+	if err != nil {
+		return nil, err
+	}
+
+	ip, err := p.hosts.ParseImportPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if ip.Commitish != "" {
+		return nil, fmt.Errorf("GoProxy: Module path '%v' cannot have a version", path)
+	}
+
+	m := &modulePath{path: ip.String(), host: ip.Host, repo: ip.Repo, subdir: ip.Subpath}
+	parts := strings.Split(ip.Subpath, "/")
+	if last := parts[len(parts)-1]; majorSuffix.MatchString(last) {
+		m.major = last
+		m.subdir = strings.Join(parts[:len(parts)-1], "/")
+	}
+	return m, nil
+}
+
+// Undo the module proxy's case encoding, where "!x" stands for "X".
+func unescapeModulePath(escaped string) (string, error) {
+	out := []rune{}
+	bang := false
+	for _, r := range escaped {
+		switch {
+		case bang && r >= 'a' && r <= 'z':
+			out = append(out, r-'a'+'A')
+			bang = false
+		case bang || (r >= 'A' && r <= 'Z'):
+			return "", fmt.Errorf("GoProxy: Invalid escaped module path '%v'", escaped)
+		case r == '!':
+			bang = true
+		default:
+			out = append(out, r)
+		}
+	}
+	if bang {
+		return "", fmt.Errorf("GoProxy: Invalid escaped module path '%v'", escaped)
+	}
+	return string(out), nil
+}
+
+// Tags of this module are prefixed with its directory, ex. "sub/v1.2.3".
+func (m *modulePath) tagPrefix() string {
+	if m.subdir == "" {
+		return "refs/tags/"
+	}
+	return "refs/tags/" + m.subdir + "/"
+}
+
+// Is the version canonical (ex. "v1.2.3" and not "1.2" or "v1.2.3+build") and
+// does it belong to this module's major version?
+func (m *modulePath) validVersion(version string) bool {
+	v, err := ParseVersion(version)
+	if err != nil || "v"+v.String() != version {
+		return false
+	}
+	if m.major == "" {
+		return v.Major <= 1
+	}
+	return fmt.Sprintf("v%d", v.Major) == m.major
+}
+
+// All tagged versions of the module, semver-sorted.
+func (m *modulePath) versions(adv *GitUploadPack) []string {
+	out := []string{}
+	for ref := range adv.refs {
+		if !strings.HasPrefix(ref, m.tagPrefix()) {
+			continue
+		}
+		if version := strings.TrimPrefix(ref, m.tagPrefix()); m.validVersion(version) {
+			out = append(out, version)
+		}
+	}
+	sortVersions(out)
+	return out
+}
+
+func sortVersions(versions []string) {
+	sort.Slice(versions, func(i, j int) bool {
+		a, _ := ParseVersion(versions[i])
+		b, _ := ParseVersion(versions[j])
+		return a.Compare(b) < 0
+	})
+}
+
+// Pseudo-versions end in "-yyyymmddhhmmss-abcdefabcdef".
+var pseudoVersion = regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+-(.+\.)?([0-9]{14})-([0-9a-f]{12})$`)
+
+// Resolve a version query ("v1.2.3", a pseudo-version, "latest", a semver
+// range, a branch or a SHA) to the commit it names. If the query does not name
+// a version of the module, the returned version is empty and must be
+// synthesized with pseudoVersionFor. Pseudo-versions of commits no ref points
+// at resolve to the abbreviated SHA, which only a full clone can expand.
+func (m *modulePath) resolve(adv *GitUploadPack, query string) (string, string, error) {
+	versions := m.versions(adv)
+
+	if m.validVersion(query) {
+		if _, ok := adv.refs[m.tagPrefix()+query]; ok {
+			return query, adv.peeled(m.tagPrefix() + query), nil
+		}
+		if match := pseudoVersion.FindStringSubmatch(query); match != nil {
+			err, commit := adv.findCommitish(match[3])
+			if err == ErrCommitishNotFound {
+				return query, match[3], nil
+			}
+			return query, commit, err
+		}
+		return "", "", fmt.Errorf("GoProxy: Unknown version %v of %v: %w", query, m.path, ErrCommitishNotFound)
+	}
+
+	// The latest release, or HEAD if there are none
+	if query == "latest" {
+		for i := len(versions) - 1; i >= 0; i-- {
+			if v, _ := ParseVersion(versions[i]); len(v.Pre) == 0 {
+				return versions[i], adv.peeled(m.tagPrefix() + versions[i]), nil
+			}
+		}
+		query = "HEAD"
+	}
+
+	if c, err := ParseConstraint(query); err == nil {
+		for i := len(versions) - 1; i >= 0; i-- {
+			if v, _ := ParseVersion(versions[i]); c.Check(v) {
+				return versions[i], adv.peeled(m.tagPrefix() + versions[i]), nil
+			}
+		}
+	}
+
+	commit := adv.refs["HEAD"]
+	if query != "HEAD" {
+		err, c := adv.findCommitish(query)
+		if err != nil {
+			return "", "", err
+		}
+		commit = c
+	}
+
+	// Prefer a tagged version of the same commit
+	for i := len(versions) - 1; i >= 0; i-- {
+		if adv.peeled(m.tagPrefix()+versions[i]) == commit {
+			return versions[i], commit, nil
+		}
+	}
+	return "", commit, nil
+}
+
+// A pseudo-version for an untagged commit, ex. "v0.0.0-20060102150405-abcdefabcdef".
+func (m *modulePath) pseudoVersionFor(commit string, t time.Time) string {
+	major := m.major
+	if major == "" {
+		major = "v0"
+	}
+	return fmt.Sprintf("%s.0.0-%s-%s", major, t.UTC().Format("20060102150405"), commit[:12])
+}
+
+// Serve the GOPROXY protocol: <module>/@v/list, <module>/@v/<version>.info,
+// .mod and .zip, and <module>/@latest.
+func (p *Proxy) serveModule(w http.ResponseWriter, r *http.Request) {
+	// Still escaped, see ParseImportPath
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/")
+	var escaped, file string
+	if i := strings.Index(path, "/@v/"); i >= 0 {
+		escaped, file = path[:i], path[i+len("/@v/"):]
+	} else {
+		escaped, file = strings.TrimSuffix(path, "/@latest"), "latest.info"
+	}
+
+	m, err := p.parseModulePath(escaped)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	repoUrl := m.host.RepoURL(m.repo)
+	if err := p.checkAccess(r, &ImportPath{VCS: "git", Host: m.host, Repo: m.repo}); err != nil {
+		log.Printf("GoProxy: Refused %v: %v", m.path, err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	// Anything but 404 keeps the go command from trying the next GOPROXY and
+	// hiding the failure
+	adv, err := p.fetchAdvertisement(repoUrl, http.Header{}, "")
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	if file == "list" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, v := range m.versions(adv) {
+			fmt.Fprintln(w, v)
+		}
+		return
+	}
+
+	file, err = url.PathUnescape(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	ext := file[strings.LastIndex(file, ".")+1:]
+	query, err := unescapeModulePath(strings.TrimSuffix(file, "."+ext))
+	if err != nil || (ext != "info" && ext != "mod" && ext != "zip") {
+		http.NotFound(w, r)
+		return
+	}
+
+	version, commit, err := m.resolve(adv, query)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	// .mod and .zip are only asked for with canonical versions
+	if ext != "info" && version != query {
+		http.Error(w, fmt.Sprintf("GoProxy: %v is not a canonical version", query), 404)
+		return
+	}
+
+	// Tagged versions mean whatever they first meant
+	if ref := m.tagPrefix() + version; p.versions != nil && version != "" {
+		if _, ok := adv.refs[ref]; ok {
+			if commit, err = p.versions.Check(repoUrl, ref, commit); err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+		}
+	}
+
+	var local *localRepo
+	if len(commit) < 40 {
+		local, commit, err = p.localAbbrevCommit(repoUrl, commit)
+	} else {
+		local, err = p.localCommit(repoUrl, commit)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer local.Remove()
+
+	// A pseudo-version names the commit by its time as well
+	if match := pseudoVersion.FindStringSubmatch(version); match != nil {
+		t, err := local.commitTime(commit)
+		if err != nil {
+			http.Error(w, err.Error(), 502)
+			return
+		} else if t.Format("20060102150405") != match[2] {
+			http.Error(w, fmt.Sprintf("GoProxy: %v does not match the time of commit %v", version, commit), 404)
+			return
+		}
+	}
+
+	switch ext {
+	case "info":
+		t, err := local.commitTime(commit)
+		if err != nil {
+			http.Error(w, err.Error(), 502)
+			return
+		}
+		if version == "" {
+			version = m.pseudoVersionFor(commit, t)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Version string
+			Time    time.Time
+		}{version, t})
+	case "mod":
+		mod, err := local.readFile(commit, inDir(m.dir(local, commit), "go.mod"))
+		if os.IsNotExist(err) {
+			mod = []byte(fmt.Sprintf("module %s\n", m.path))
+		} else if err != nil {
+			http.Error(w, err.Error(), 502)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(mod)
+	case "zip":
+		tarball, err := local.archive(commit)
+		if err != nil {
+			http.Error(w, err.Error(), 502)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		if err := m.writeZip(w, tarball, m.dir(local, commit), version); err != nil {
+			log.Printf("GoProxy: Cannot write %v@%v.zip: %v", m.path, version, err)
+		}
+	}
+}
+
+// The module's directory at a commit, relative to the repository root. As
+// with the go command, a major version is looked for in its own subdirectory
+// ("sub/v2") first, and otherwise in the directory it is a major version of
+// ("sub").
+func (m *modulePath) dir(local *localRepo, commit string) string {
+	if m.major != "" {
+		dir := inDir(m.subdir, m.major)
+		if local.has(fmt.Sprintf("%s:%s", commit, inDir(dir, "go.mod"))) {
+			return dir
+		}
+	}
+	return m.subdir
+}
+
+// Path of a file in a directory, relative to the repository root.
+func inDir(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// Write the module zip for the given version from a tar archive of the
+// repository and the module's directory in it, following the rules of
+// golang.org/x/mod/zip: only regular files, no nested modules and no vendored
+// packages. A LICENSE in the repository root is included for modules in
+// subdirectories lacking their own.
+func (m *modulePath) writeZip(w io.Writer, tarball io.Reader, dir, version string) error {
+	files := map[string][]byte{}
+	names := []string{}
+	var rootLicense []byte
+
+	tr := tar.NewReader(tarball)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if hdr.Name == "LICENSE" {
+			rootLicense = data
+		}
+
+		name := hdr.Name
+		if dir != "" {
+			if !strings.HasPrefix(name, dir+"/") {
+				continue
+			}
+			name = strings.TrimPrefix(name, dir+"/")
+		}
+		files[name] = data
+		names = append(names, name)
+	}
+
+	if _, ok := files["LICENSE"]; !ok && rootLicense != nil {
+		files["LICENSE"] = rootLicense
+		names = append(names, "LICENSE")
+	}
+
+	// Directories with their own go.mod are other modules
+	nested := []string{}
+	for _, name := range names {
+		if strings.HasSuffix(name, "/go.mod") {
+			nested = append(nested, strings.TrimSuffix(name, "go.mod"))
+		}
+	}
+
+	sort.Strings(names)
+	zw := zip.NewWriter(w)
+	for _, name := range names {
+		if isVendoredPackage(name) || hasAnyPrefix(name, nested) {
+			continue
+		}
+		f, err := zw.Create(fmt.Sprintf("%s@%s/%s", m.path, version, name))
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(files[name]); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// Files in subdirectories of vendor/ are excluded; vendor/modules.txt is not.
+func isVendoredPackage(name string) bool {
+	var i int
+	if strings.HasPrefix(name, "vendor/") {
+		i += len("vendor/")
+	} else if j := strings.Index(name, "/vendor/"); j >= 0 {
+		// Not j + len(...); x/mod/zip gets this wrong, and the module
+		// checksums depend on it.
+		i += len("/vendor/")
+	} else {
+		return false
+	}
+	return strings.Contains(name[i:], "/")
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func runTestGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=Test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=Test", "GIT_COMMITTER_EMAIL=test@example.com",
+		"GIT_AUTHOR_DATE=2014-01-02T03:04:05Z", "GIT_COMMITTER_DATE=2014-01-02T03:04:05Z",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v failed: %v\n%s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Create a bare repository foo/bar below a temporary directory, served over
+// smart HTTP by git http-backend, and a proxy with "git.example.com" pointed
+// at it. The repository has tags v1.0.0, v1.1.0 (annotated) and v1.2.0-rc1,
+// and one untagged commit on top.
+func newTestGitUpstream(t *testing.T) (*Proxy, *httptest.Server, string) {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not installed")
+	}
+
+	root, err := ioutil.TempDir("", "gvp-upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	work := filepath.Join(root, "work")
+	os.MkdirAll(filepath.Join(work, "sub"), 0755)
+	os.MkdirAll(filepath.Join(work, "vendor", "x"), 0755)
+
+	files := map[string]string{
+		"go.mod":             "module git.example.com/foo/bar\n",
+		"bar.go":             "package bar\n",
+		"LICENSE":            "MIT\n",
+		"sub/go.mod":         "module git.example.com/foo/bar/sub\n",
+		"sub/sub.go":         "package sub\n",
+		"vendor/modules.txt": "# x\n",
+		"vendor/x/x.go":      "package x\n",
+	}
+	for name, content := range files {
+		ioutil.WriteFile(filepath.Join(work, name), []byte(content), 0644)
+	}
+
+	runTestGit(t, work, "init", "--quiet")
+	runTestGit(t, work, "checkout", "--quiet", "-b", "master")
+	runTestGit(t, work, "add", ".")
+	runTestGit(t, work, "commit", "--quiet", "-m", "Initial")
+	runTestGit(t, work, "tag", "v1.0.0")
+	ioutil.WriteFile(filepath.Join(work, "bar.go"), []byte("package bar\n\n// v1.1\n"), 0644)
+	runTestGit(t, work, "commit", "--quiet", "-am", "Second")
+	runTestGit(t, work, "tag", "-a", "-m", "Release", "v1.1.0")
+	runTestGit(t, work, "tag", "v1.2.0-rc1")
+	ioutil.WriteFile(filepath.Join(work, "bar.go"), []byte("package bar\n\n// tip\n"), 0644)
+	runTestGit(t, work, "commit", "--quiet", "-am", "Third")
+
+	os.MkdirAll(filepath.Join(root, "foo"), 0755)
+	runTestGit(t, root, "clone", "--quiet", "--bare", work, filepath.Join(root, "foo", "bar"))
+
+	upstream := httptest.NewServer(&cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	})
+
+	c := NewConfig()
+	c.Hosts = []*Host{{Name: "git.example.com", URL: upstream.URL + "/{repo}", RootDepth: 2}}
+	c.AllowPrivateNetworks = true
+	p, err := NewProxy(c)
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	return p, upstream, root
+}
+
+func TestParseModulePath(t *testing.T) {
+	p, _ := NewProxy(NewConfig())
+
+	var tests = []struct {
+		in     string
+		path   string
+		repo   string
+		subdir string
+		major  string
+	}{
+		{"github.com/foo/bar", "github.com/foo/bar", "foo/bar", "", ""},
+		{"github.com/!foo/bar/v2", "github.com/Foo/bar/v2", "Foo/bar", "", "v2"},
+		{"github.com/foo/bar/sub/pkg/v10", "github.com/foo/bar/sub/pkg/v10", "foo/bar", "sub/pkg", "v10"},
+		{"github.com/foo/bar/v1", "github.com/foo/bar/v1", "foo/bar", "v1", ""},
+	}
+
+	for _, tt := range tests {
+		m, err := p.parseModulePath(tt.in)
+		if err != nil {
+			t.Errorf("parseModulePath(%v) failed: %v", tt.in, err)
+			continue
+		}
+		if m.path != tt.path || m.repo != tt.repo || m.subdir != tt.subdir || m.major != tt.major {
+			t.Errorf("parseModulePath(%v): Unexpected %+v", tt.in, m)
+		}
+	}
+
+	for _, in := range []string{"github.com/Foo/bar", "github.com/foo/bar!", "example.org/foo/bar"} {
+		if _, err := p.parseModulePath(in); err == nil {
+			t.Errorf("Expected parseModulePath(%v) to fail", in)
+		}
+	}
+}
+
+func TestServeModule(t *testing.T) {
+	p, upstream, root := newTestGitUpstream(t)
+	defer os.RemoveAll(root)
+	defer upstream.Close()
+
+	get := func(path string) (int, []byte) {
+		w := httptest.NewRecorder()
+		p.Handler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.Bytes()
+	}
+
+	if code, body := get("/git.example.com/foo/bar/@v/list"); code != 200 || string(body) != "v1.0.0\nv1.1.0\nv1.2.0-rc1\n" {
+		t.Errorf("Unexpected list: %v %q", code, body)
+	}
+
+	tip := runTestGit(t, filepath.Join(root, "foo", "bar"), "rev-parse", "master")
+	var tests = []struct {
+		path    string
+		version string
+	}{
+		{"/git.example.com/foo/bar/@latest", "v1.1.0"},
+		{"/git.example.com/foo/bar/@v/v1.0.0.info", "v1.0.0"},
+		{"/git.example.com/foo/bar/@v/v1.info", "v1.1.0"},
+		{"/git.example.com/foo/bar/@v/master.info", "v0.0.0-20140102030405-" + tip[:12]},
+	}
+
+	for _, tt := range tests {
+		code, body := get(tt.path)
+		var info struct{ Version string }
+		if err := json.Unmarshal(body, &info); code != 200 || err != nil || info.Version != tt.version {
+			t.Errorf("GET %v: Expected version %v, got %v %q", tt.path, tt.version, code, body)
+		}
+	}
+
+	if code, body := get("/git.example.com/foo/bar/@v/v1.0.0.mod"); code != 200 || string(body) != "module git.example.com/foo/bar\n" {
+		t.Errorf("Unexpected go.mod: %v %q", code, body)
+	}
+
+	code, body := get("/git.example.com/foo/bar/@v/v1.1.0.zip")
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if code != 200 || err != nil {
+		t.Fatalf("Expected a zip, got %v %v", code, err)
+	}
+	names := []string{}
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	exp := []string{
+		"git.example.com/foo/bar@v1.1.0/LICENSE",
+		"git.example.com/foo/bar@v1.1.0/bar.go",
+		"git.example.com/foo/bar@v1.1.0/go.mod",
+		"git.example.com/foo/bar@v1.1.0/vendor/modules.txt",
+	}
+	if strings.Join(names, "\n") != strings.Join(exp, "\n") {
+		t.Errorf("Expected zip to contain\n%v\nGot\n%v", exp, names)
+	}
+
+	for _, path := range []string{"/git.example.com/foo/bar/@v/v9.9.9.info", "/git.example.com/foo/bar/@v/master.zip"} {
+		if code, _ := get(path); code != 404 {
+			t.Errorf("Expected GET %v to give 404, got %v", path, code)
+		}
+	}
+}
+
+func TestServeModulePseudoVersion(t *testing.T) {
+	p, upstream, root := newTestGitUpstream(t)
+	defer os.RemoveAll(root)
+	defer upstream.Close()
+
+	// Two more commits on master, so the first is no ref's tip
+	work, bare := filepath.Join(root, "work"), filepath.Join(root, "foo", "bar")
+	for _, msg := range []string{"Fourth", "Fifth"} {
+		ioutil.WriteFile(filepath.Join(work, "bar.go"), []byte("package bar\n\n// "+msg+"\n"), 0644)
+		runTestGit(t, work, "commit", "--quiet", "-am", msg)
+	}
+	runTestGit(t, work, "push", "--quiet", bare, "master")
+	old := runTestGit(t, work, "rev-parse", "HEAD~1")
+
+	var tests = []struct {
+		path   string
+		status int
+	}{
+		{"/git.example.com/foo/bar/@v/v1.1.1-0.20140102030405-" + old[:12] + ".info", 200},
+		{"/git.example.com/foo/bar/@v/v1.1.1-0.20140102030405-" + old[:12] + ".mod", 200},
+		{"/git.example.com/foo/bar/@v/v1.1.1-0.20140102030406-" + old[:12] + ".info", 404},
+		{"/git.example.com/foo/bar/@v/v1.1.1-0.20140102030405-aaaaaaaaaaaa.info", 404},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		p.Handler().ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("GET %v: Expected %v, got %v %q", tt.path, tt.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestServeModuleMajorVersion(t *testing.T) {
+	p, upstream, root := newTestGitUpstream(t)
+	defer os.RemoveAll(root)
+	defer upstream.Close()
+
+	// v2 in its own subdirectory; v3 without one, so in the root
+	work, bare := filepath.Join(root, "work"), filepath.Join(root, "foo", "bar")
+	os.MkdirAll(filepath.Join(work, "v2"), 0755)
+	ioutil.WriteFile(filepath.Join(work, "v2", "go.mod"), []byte("module git.example.com/foo/bar/v2\n"), 0644)
+	ioutil.WriteFile(filepath.Join(work, "v2", "bar.go"), []byte("package bar\n"), 0644)
+	runTestGit(t, work, "add", ".")
+	runTestGit(t, work, "commit", "--quiet", "-m", "v2")
+	runTestGit(t, work, "tag", "v2.0.0")
+	runTestGit(t, work, "tag", "v3.0.0")
+	runTestGit(t, work, "push", "--quiet", "--tags", bare, "master")
+
+	get := func(path string) (int, []byte) {
+		w := httptest.NewRecorder()
+		p.Handler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.Bytes()
+	}
+
+	var tests = []struct {
+		path string
+		mod  string
+	}{
+		{"/git.example.com/foo/bar/v2/@v/v2.0.0.mod", "module git.example.com/foo/bar/v2\n"},
+		{"/git.example.com/foo/bar/v3/@v/v3.0.0.mod", "module git.example.com/foo/bar\n"},
+	}
+	for _, tt := range tests {
+		if code, body := get(tt.path); code != 200 || string(body) != tt.mod {
+			t.Errorf("GET %v: Expected %q, got %v %q", tt.path, tt.mod, code, body)
+		}
+	}
+
+	code, body := get("/git.example.com/foo/bar/v2/@v/v2.0.0.zip")
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if code != 200 || err != nil {
+		t.Fatalf("Expected a zip, got %v %v", code, err)
+	}
+	names := []string{}
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	exp := []string{
+		"git.example.com/foo/bar/v2@v2.0.0/LICENSE",
+		"git.example.com/foo/bar/v2@v2.0.0/bar.go",
+		"git.example.com/foo/bar/v2@v2.0.0/go.mod",
+	}
+	if strings.Join(names, "\n") != strings.Join(exp, "\n") {
+		t.Errorf("Expected zip to contain\n%v\nGot\n%v", exp, names)
+	}
+
+	// An escaped "/" does not make up a module path
+	if code, _ := get("/git.example.com/foo%2Fbar/x/@v/list"); code != 404 {
+		t.Errorf("Expected an escaped / to give 404, got %v", code)
+	}
+}
+
+func TestServeModuleUpstreamErrors(t *testing.T) {
+	p, upstream := newTestProxyWithUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/foo/down/") {
+			http.Error(w, "Down for maintenance", 503)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+
+	// Only unknown modules may send the go command on to the next proxy
+	var tests = []struct {
+		path   string
+		status int
+	}{
+		{"/git.example.com/foo/down/@v/list", 502},
+		{"/git.example.com/foo/down/@v/v1.0.0.info", 502},
+		{"/git.example.com/foo/missing/@v/list", 404},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		p.Handler().ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("GET %v: Expected %v, got %v %q", tt.path, tt.status, w.Code, w.Body.String())
+		}
+	}
+}
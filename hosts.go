@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// An upstream VCS host we know how to proxy.
+type Host struct {
+	// Hostname as it appears in import paths, ex. "github.com".
+	Name string `json:"name"`
+	// Upstream repository URL. "{host}" and "{repo}" are replaced by the
+	// hostname and the repository path, ex. "https://{host}/{repo}".
+	URL string `json:"url"`
+	// Number of path segments after the hostname making up the repository
+	// root; 2 for "github.com/user/repo".
+	RootDepth int `json:"root_depth"`
+}
+
+var defaultHosts = []*Host{
+	{Name: "github.com", URL: "https://{host}/{repo}", RootDepth: 2},
+	{Name: "gitlab.com", URL: "https://{host}/{repo}", RootDepth: 2},
+	{Name: "bitbucket.org", URL: "https://{host}/{repo}", RootDepth: 2},
+}
+
+// URL of the given repository (ex. "user/repo") on this host.
+func (h *Host) RepoURL(repo string) string {
+	return strings.NewReplacer("{host}", h.Name, "{repo}", repo).Replace(h.URL)
+}
+
+type HostRegistry struct {
+	hosts map[string]*Host
+}
+
+// Create a registry with the default hosts (github.com, gitlab.com and
+// bitbucket.org) registered.
+func NewHostRegistry() *HostRegistry {
+	r := &HostRegistry{hosts: make(map[string]*Host)}
+	for _, h := range defaultHosts {
+		r.Add(h)
+	}
+	return r
+}
+
+// Register a host, replacing any existing one with the same name.
+func (r *HostRegistry) Add(h *Host) error {
+	if h.Name == "" || strings.Contains(h.Name, "/") {
+		return fmt.Errorf("HostRegistry: Invalid host name '%v'", h.Name)
+	}
+	if !strings.Contains(h.URL, "{repo}") {
+		return fmt.Errorf("HostRegistry: URL for %v must contain {repo}", h.Name)
+	}
+	if h.RootDepth < 1 {
+		return fmt.Errorf("HostRegistry: root_depth for %v must be at least 1", h.Name)
+	}
+	r.hosts[h.Name] = h
+	return nil
+}
+
+var ErrUnknownHost = errors.New("Unknown host")
+
+// Find the host of a path like "github.com/user/repo/..." and return it with
+// the remainder of the path.
+func (r *HostRegistry) Lookup(path string) (*Host, string, error) {
+	parts := strings.SplitN(strings.Trim(path, "/"), "/", 2)
+	h, ok := r.hosts[parts[0]]
+	if !ok {
+		return nil, "", ErrUnknownHost
+	}
+	if len(parts) == 1 {
+		return h, "", nil
+	}
+	return h, parts[1], nil
+}
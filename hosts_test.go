@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHostRegistryLookup(t *testing.T) {
+	r := NewHostRegistry()
+	err := r.Add(&Host{Name: "git.example.com", URL: "https://{host}/scm/{repo}.git", RootDepth: 3})
+	if err != nil {
+		t.Fatalf("Failed adding host: %v", err)
+	}
+
+	var tests = []struct {
+		in   string
+		rest string
+		repo string
+		url  string
+	}{
+		{"/github.com/foo/bar.git/info/refs", "foo/bar.git/info/refs", "foo/bar.git", "https://github.com/foo/bar.git"},
+		{"gitlab.com/foo/bar", "foo/bar", "foo/bar", "https://gitlab.com/foo/bar"},
+		{"git.example.com/a/b/c/sub/pkg", "a/b/c/sub/pkg", "a/b/c", "https://git.example.com/scm/a/b/c.git"},
+	}
+
+	for _, tt := range tests {
+		h, rest, err := r.Lookup(tt.in)
+		if err != nil {
+			t.Errorf("Lookup(%v) failed: %v", tt.in, err)
+			continue
+		}
+		if rest != tt.rest || h.RepoURL(tt.repo) != tt.url {
+			t.Errorf(
+				"Expected %v to give (%v, %v), got (%v, %v)",
+				tt.in, tt.rest, tt.url, rest, h.RepoURL(tt.repo),
+			)
+		}
+	}
+
+	if _, _, err := r.Lookup("example.org/foo/bar"); err != ErrUnknownHost {
+		t.Errorf("Expected ErrUnknownHost, got %v", err)
+	}
+}
+
+func TestHostRegistryAdd(t *testing.T) {
+	r := NewHostRegistry()
+	var bad = []*Host{
+		{Name: "", URL: "https://{host}/{repo}", RootDepth: 2},
+		{Name: "a/b", URL: "https://{host}/{repo}", RootDepth: 2},
+		{Name: "example.com", URL: "https://example.com/", RootDepth: 2},
+		{Name: "example.com", URL: "https://{host}/{repo}", RootDepth: 0},
+	}
+
+	for _, h := range bad {
+		if err := r.Add(h); err == nil {
+			t.Errorf("Expected %+v to be rejected", h)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// A request path split into its parts, ex. "github.com/user/repo@v1.2/sub/pkg"
+// is the git repository "user/repo" on github.com at v1.2, package "sub/pkg".
+//
+// The version goes right after the repository root, either on its last
+// segment ("repo@v1.2") or as a segment of its own ("repo/@v1.2").
+type ImportPath struct {
+	VCS  string
+	Host *Host
+	// Repository below the host, ex. "user/repo".
+	Repo string
+	// Path within the repository, ex. "sub/pkg" or "info/refs".
+	Subpath string
+	// The requested version; empty if there is none.
+	Commitish string
+	// Whether the version was a segment of its own, as in "repo/@v1.2".
+	VersionSegment bool
+}
+
+var ErrMultipleVersions = errors.New("ImportPath: More than one @version")
+
+// Parse a URL path as sent by the client, still escaped. Each segment is
+// unescaped on its own, so an escaped "/" cannot make up extra segments.
+func (r *HostRegistry) ParseImportPath(escaped string) (*ImportPath, error) {
+	segments := []string{}
+	for _, s := range strings.Split(escaped, "/") {
+		if s == "" {
+			continue
+		}
+		segment, err := url.PathUnescape(s)
+		if err != nil || segment == "." || segment == ".." || strings.ContainsAny(segment, "/\\\x00") {
+			return nil, fmt.Errorf("ImportPath: Invalid path segment '%v'", s)
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) == 0 {
+		return nil, ErrUnknownHost
+	}
+	if strings.Count(strings.Join(segments, "/"), "@") > 1 {
+		return nil, ErrMultipleVersions
+	}
+
+	h, _, err := r.Lookup(segments[0])
+	if err != nil {
+		return nil, err
+	}
+	ip := &ImportPath{VCS: "git", Host: h}
+
+	rest := segments[1:]
+	for i, s := range rest {
+		at := strings.Index(s, "@")
+		switch {
+		case at < 0:
+			continue
+		case at > 0 && i == h.RootDepth-1:
+			ip.Commitish = s[at+1:]
+			rest[i] = s[:at]
+		case at == 0 && i == h.RootDepth:
+			ip.Commitish = s[1:]
+			ip.VersionSegment = true
+			rest = append(rest[:i:i], rest[i+1:]...)
+		default:
+			return nil, fmt.Errorf("ImportPath: @version must follow the repository in '%v'", escaped)
+		}
+		if ip.Commitish == "" {
+			return nil, fmt.Errorf("ImportPath: Empty @version in '%v'", escaped)
+		}
+		break
+	}
+
+	if len(rest) < h.RootDepth {
+		return nil, fmt.Errorf("ImportPath: '%v' is not a %v repository", escaped, h.Name)
+	}
+	ip.Repo = strings.Join(rest[:h.RootDepth], "/")
+	ip.Subpath = strings.Join(rest[h.RootDepth:], "/")
+	return ip, nil
+}
+
+// The repository root, ex. "github.com/user/repo".
+func (ip *ImportPath) Root() string {
+	return ip.Host.Name + "/" + ip.Repo
+}
+
+// The repository root with the version, if any, written the way it was
+// parsed, ex. "github.com/user/repo@v1.2" or "github.com/user/repo/@v1.2".
+func (ip *ImportPath) VersionedRoot() string {
+	switch {
+	case ip.Commitish == "":
+		return ip.Root()
+	case ip.VersionSegment:
+		return ip.Root() + "/@" + ip.Commitish
+	}
+	return ip.Root() + "@" + ip.Commitish
+}
+
+// The path as it would be written, ex. "github.com/user/repo@v1.2/sub/pkg".
+func (ip *ImportPath) String() string {
+	s := ip.VersionedRoot()
+	if ip.Subpath != "" {
+		s += "/" + ip.Subpath
+	}
+	return s
+}
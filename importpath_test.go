@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseImportPath(t *testing.T) {
+	r := NewHostRegistry()
+	r.Add(&Host{Name: "git.example.com", URL: "https://{host}/{repo}", RootDepth: 3})
+
+	var tests = []struct {
+		in        string
+		repo      string
+		subpath   string
+		commitish string
+	}{
+		{"/github.com/foo/bar.git/@master", "foo/bar.git", "", "master"},
+		{"/github.com/foo/bar@master", "foo/bar", "", "master"},
+		{"/github.com/coreos/etcd@v0.1.0", "coreos/etcd", "", "v0.1.0"},
+		{"/github.com/coreos/etcd", "coreos/etcd", "", ""},
+		{"/github.com/foo/bar@v1.2/sub/pkg", "foo/bar", "sub/pkg", "v1.2"},
+		{"/github.com/foo/bar/@v1.2/info/refs", "foo/bar", "info/refs", "v1.2"},
+		{"/github.com/foo/bar/sub/pkg", "foo/bar", "sub/pkg", ""},
+		{"/github.com/foo/bar@%5E1.2.0", "foo/bar", "", "^1.2.0"},
+		{"/github.com/foo/bar@%3E%3D1.0%20%3C2", "foo/bar", "", ">=1.0 <2"},
+		{"/git.example.com/group/sub/repo@v1/pkg", "group/sub/repo", "pkg", "v1"},
+	}
+
+	for _, tt := range tests {
+		ip, err := r.ParseImportPath(tt.in)
+		if err != nil {
+			t.Errorf("ParseImportPath(%v) failed: %v", tt.in, err)
+			continue
+		}
+		if ip.VCS != "git" || ip.Repo != tt.repo || ip.Subpath != tt.subpath || ip.Commitish != tt.commitish {
+			t.Errorf(
+				"Expected %v to have repo %v, subpath %v and commitish %v, got %v, %v and %v",
+				tt.in, tt.repo, tt.subpath, tt.commitish, ip.Repo, ip.Subpath, ip.Commitish,
+			)
+		}
+	}
+
+	var bad = []struct {
+		in  string
+		err string
+	}{
+		{"/github.com/foo/@master/bar.git", "ImportPath: @version must follow the repository in '/github.com/foo/@master/bar.git'"},
+		{"/github.com@v1/foo/bar", "Unknown host"},
+		{"/github.com/foo@v1/bar", "ImportPath: @version must follow the repository in '/github.com/foo@v1/bar'"},
+		{"/github.com/foo/bar/sub@v1", "ImportPath: @version must follow the repository in '/github.com/foo/bar/sub@v1'"},
+		{"/github.com/foo/bar@v1/@v2", "ImportPath: More than one @version"},
+		{"/github.com/foo/bar@v1@v2", "ImportPath: More than one @version"},
+		{"/github.com/foo/bar@", "ImportPath: Empty @version in '/github.com/foo/bar@'"},
+		{"/github.com/foo", "ImportPath: '/github.com/foo' is not a github.com repository"},
+		{"/github.com/foo%2Fbar/baz", "ImportPath: Invalid path segment 'foo%2Fbar'"},
+		{"/github.com/foo/%2e%2e", "ImportPath: Invalid path segment '%2e%2e'"},
+		{"/github.com/foo/bar%zz", "ImportPath: Invalid path segment 'bar%zz'"},
+		{"/", "Unknown host"},
+	}
+
+	for _, tt := range bad {
+		if _, err := r.ParseImportPath(tt.in); err == nil || err.Error() != tt.err {
+			t.Errorf("ParseImportPath(%v): Expected error '%v', got %v", tt.in, tt.err, err)
+		}
+	}
+}
+
+func TestImportPathString(t *testing.T) {
+	r := NewHostRegistry()
+	for _, in := range []string{"github.com/foo/bar", "github.com/foo/bar@v1.2", "github.com/foo/bar@v1.2/sub/pkg", "github.com/foo/bar/@v1.2/sub/pkg"} {
+		ip, err := r.ParseImportPath(in)
+		if err != nil {
+			t.Fatalf("ParseImportPath(%v) failed: %v", in, err)
+		}
+		if ip.String() != in {
+			t.Errorf("Expected %v, got %v", in, ip.String())
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bare mirrors of upstream repositories on local disk. Each is cloned on first
+// access and fetched again in the background once it is older than refresh,
+// so clients are served from the mirror even when upstream is down.
+//
+// Mirrors is an http.RoundTripper answering the smart HTTP requests for
+// info/refs and git-upload-pack itself, with a local git upload-pack; anything
+// else goes to next.
+type Mirrors struct {
+	dir     string
+	refresh time.Duration
+	next    http.RoundTripper
+	// Never clone or fetch.
+	offline bool
+	// For cloning and fetching from upstream.
+	credentials *Credentials
+	policy      *UpstreamPolicy
+
+	mu    sync.Mutex
+	repos map[string]*mirror
+}
+
+type mirror struct {
+	sync.Mutex // Held while cloning
+	local      *localRepo
+	fetched    time.Time
+	refreshing bool
+}
+
+// Written to a mirror after each successful fetch; its mtime is the last one.
+const mirrorStamp = "git-version-proxy-fetched"
+
+func NewMirrors(dir string, refresh time.Duration, next http.RoundTripper) (*Mirrors, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Mirrors{dir: dir, refresh: refresh, next: next, repos: make(map[string]*mirror)}, nil
+}
+
+// Where the mirror of an upstream repository lives, ex.
+// "<dir>/github.com/foo/bar.git".
+func (m *Mirrors) path(repoUrl string) (string, error) {
+	u, err := url.Parse(repoUrl)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(m.dir, u.Host, filepath.FromSlash(filepath.Clean("/"+u.Path)))
+	if !strings.HasSuffix(path, ".git") {
+		path += ".git"
+	}
+	return path, nil
+}
+
+// Get the mirror of an upstream repository, cloning it if needed and
+// starting a background refresh if it is getting old.
+func (m *Mirrors) get(repoUrl string) (*localRepo, error) {
+	m.mu.Lock()
+	mi, ok := m.repos[repoUrl]
+	if !ok {
+		mi = &mirror{}
+		m.repos[repoUrl] = mi
+	}
+	m.mu.Unlock()
+
+	mi.Lock()
+	defer mi.Unlock()
+
+	if mi.local == nil {
+		path, err := m.path(repoUrl)
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(filepath.Join(path, mirrorStamp)); err == nil {
+			// Left over from an earlier run
+			mi.local, mi.fetched = m.localRepo(repoUrl, path), info.ModTime()
+		} else if m.offline {
+			return nil, ErrOffline
+		} else if mi.local, err = m.clone(repoUrl, path); err != nil {
+			return nil, err
+		} else {
+			mi.fetched = time.Now()
+		}
+	}
+
+	if time.Since(mi.fetched) > m.refresh && !mi.refreshing && !m.offline {
+		mi.refreshing = true
+		go m.fetch(repoUrl, mi)
+	}
+	return mi.local, nil
+}
+
+func (m *Mirrors) clone(repoUrl, path string) (*localRepo, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(path), ".clone")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	l := m.localRepo(repoUrl, filepath.Dir(path))
+	if _, err := l.gitUpstream(repoUrl, "clone", "--quiet", "--mirror", repoUrl, tmp); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, mirrorStamp), nil, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return m.localRepo(repoUrl, path), nil
+}
+
+// A local repository that can talk to the given upstream repository.
+func (m *Mirrors) localRepo(repoUrl, dir string) *localRepo {
+	return &localRepo{dir: dir, env: m.credentials.gitEnv(repoUrl), policy: m.policy}
+}
+
+func (m *Mirrors) fetch(repoUrl string, mi *mirror) {
+	_, err := mi.local.gitUpstream(repoUrl, "fetch", "--quiet", "--prune", "origin")
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(mi.local.dir, mirrorStamp), nil, 0644)
+	}
+
+	mi.Lock()
+	defer mi.Unlock()
+	mi.refreshing = false
+	if err != nil {
+		log.Printf("Mirror: Cannot refresh %v: %v", repoUrl, err)
+		return
+	}
+	mi.fetched = time.Now()
+}
+
+func (m *Mirrors) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := req.URL.Path
+	var advertise bool
+	switch {
+	case req.Method == "GET" && strings.HasSuffix(path, "/info/refs") &&
+		req.URL.Query().Get("service") == "git-upload-pack":
+		advertise = true
+		path = strings.TrimSuffix(path, "/info/refs")
+	case req.Method == "POST" && strings.HasSuffix(path, "/git-upload-pack"):
+		path = strings.TrimSuffix(path, "/git-upload-pack")
+	default:
+		return m.next.RoundTrip(req)
+	}
+
+	repoUrl := fmt.Sprintf("%s://%s%s", req.URL.Scheme, req.URL.Host, path)
+	local, err := m.get(repoUrl)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return local.serveUploadPack(req, advertise)
+}
+
+// Answer a smart HTTP request with git upload-pack, as git http-backend does.
+func (l *localRepo) serveUploadPack(req *http.Request, advertise bool) (*http.Response, error) {
+	res := &http.Response{
+		StatusCode: 200,
+		Status:     "200 OK",
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Request:    req,
+	}
+	res.Header.Set("Cache-Control", "no-cache")
+
+	var stdin io.Reader
+	var closers []io.Closer
+	if advertise {
+		res.Header.Set("Content-Type", "application/x-git-upload-pack-advertisement")
+	} else {
+		res.Header.Set("Content-Type", "application/x-git-upload-pack-result")
+		stdin, closers = req.Body, []io.Closer{req.Body}
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(req.Body)
+			if err != nil {
+				req.Body.Close()
+				return nil, err
+			}
+			stdin, closers = gz, []io.Closer{gz, req.Body}
+		}
+	}
+
+	out, err := l.uploadPack(req.Header.Get("Git-Protocol"), advertise, stdin, closers...)
+	if err != nil {
+		return nil, err
+	}
+	if advertise {
+		out = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(strings.NewReader("001e# service=git-upload-pack\n0000"), out), out}
+	}
+	res.Body = out
+	return res, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorServesWithoutUpstream(t *testing.T) {
+	p, upstream, root := newTestGitUpstream(t)
+	defer os.RemoveAll(root)
+
+	mirrors, err := NewMirrors(filepath.Join(root, "mirrors"), time.Hour, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mirrors = mirrors
+	p.client.Transport = mirrors
+
+	// First access clones the mirror
+	w := httptest.NewRecorder()
+	p.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/_git/git.example.com/foo/bar@v1.0.0/info/refs?service=git-upload-pack", nil))
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %v: %s", w.Code, w.Body.String())
+	}
+	path, _ := mirrors.path(upstream.URL + "/foo/bar")
+	if _, err := os.Stat(filepath.Join(path, "HEAD")); err != nil {
+		t.Errorf("Expected a mirror to be cloned: %v", err)
+	}
+
+	// From now on, upstream is not needed
+	upstream.Close()
+
+	proxy := httptest.NewServer(p.Handler())
+	defer proxy.Close()
+
+	exp := runTestGit(t, filepath.Join(root, "foo", "bar"), "rev-parse", "v1.0.0")
+	for _, version := range []string{"0", "2"} {
+		dest := filepath.Join(root, "clone-v"+version)
+		runTestGit(t, root, "-c", "protocol.version="+version, "clone", "--quiet", proxy.URL+"/_git/git.example.com/foo/bar@v1.0.0", dest)
+
+		if got := runTestGit(t, dest, "rev-parse", "HEAD"); got != exp {
+			t.Errorf("Protocol v%v: Expected clone at v1.0.0 (%v), got %v", version, exp, got)
+		}
+		if content, _ := ioutil.ReadFile(filepath.Join(dest, "bar.go")); string(content) != "package bar\n" {
+			t.Errorf("Protocol v%v: Unexpected bar.go at v1.0.0: %q", version, content)
+		}
+	}
+}
+
+func TestOffline(t *testing.T) {
+	p, upstream, root := newTestGitUpstream(t)
+	defer os.RemoveAll(root)
+	defer upstream.Close()
+
+	// Fill the mirror while online
+	c := *p.config
+	c.MirrorDir = filepath.Join(root, "mirrors")
+	online, err := NewProxy(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	online.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/_git/git.example.com/foo/bar/info/refs?service=git-upload-pack", nil))
+	if w.Code != 200 {
+		t.Fatalf("Expected 200 while online, got %v", w.Code)
+	}
+
+	var tests = []struct {
+		path   string
+		status int
+		err    string
+	}{
+		{"/_git/git.example.com/foo/bar@v1.0.0/info/refs?service=git-upload-pack", 200, ""},
+		{"/_git/git.example.com/foo/bar@v9.9.9/info/refs?service=git-upload-pack", 404, "ERR git.example.com/foo/bar@v9.9.9 is not in the offline store\n"},
+		{"/_git/git.example.com/foo/baz@v1.0.0/info/refs?service=git-upload-pack", 404, "ERR git.example.com/foo/baz@v1.0.0 is not in the offline store\n"},
+	}
+
+	// With a cache that never saw the repository, the mirror answers
+	c.Offline = true
+	for _, cacheDir := range []string{"", filepath.Join(root, "cache")} {
+		c.CacheDir = cacheDir
+		offline, err := NewProxy(&c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range tests {
+			w := httptest.NewRecorder()
+			offline.Handler().ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.status || (tt.err != "" && !strings.HasSuffix(w.Body.String(), writePktLine(tt.err))) {
+				t.Errorf("GET %v with cache '%v': Expected %v %q, got %v %q", tt.path, cacheDir, tt.status, tt.err, w.Code, w.Body.String())
+			}
+		}
+
+		// Nothing was fetched for the unknown repository
+		if path, _ := offline.mirrors.path(upstream.URL + "/foo/baz"); exists(path) {
+			t.Errorf("Did not expect %v to be cloned while offline", path)
+		}
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Returned for anything that would need upstream in offline mode.
+var ErrOffline = errors.New("not in the offline store")
+
+// A transport refusing to talk to upstream at all.
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return nil, ErrOffline
+}
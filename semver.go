@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A semantic version, see http://semver.org/. Build metadata is ignored.
+type Version struct {
+	Major, Minor, Patch int
+	Pre                 []string
+}
+
+// Parse a complete version, ex. "v1.2.3" or "1.2.3-rc.1+build". The leading
+// "v" is optional.
+func ParseVersion(s string) (*Version, error) {
+	v, n, err := parsePartialVersion(s)
+	if err != nil {
+		return nil, err
+	}
+	if n != 3 {
+		return nil, fmt.Errorf("Semver: '%v' is not a complete version", s)
+	}
+	return v, nil
+}
+
+// Parse a possibly partial version ("1", "1.2", "1.x", "*", "1.2.3-rc1"),
+// returning it and the number of components given. Wildcards and missing
+// components are zero.
+func parsePartialVersion(s string) (*Version, int, error) {
+	orig := s
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "="), "v")
+	if i := strings.Index(s, "+"); i >= 0 {
+		s = s[:i]
+	}
+
+	v := &Version{}
+	if i := strings.Index(s, "-"); i >= 0 {
+		v.Pre = strings.Split(s[i+1:], ".")
+		s = s[:i]
+		for _, id := range v.Pre {
+			if id == "" {
+				return nil, 0, fmt.Errorf("Semver: Empty pre-release identifier in '%v'", orig)
+			}
+		}
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return nil, 0, fmt.Errorf("Semver: Too many components in '%v'", orig)
+	}
+
+	fields := []*int{&v.Major, &v.Minor, &v.Patch}
+	n := 0
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		num, err := strconv.Atoi(part)
+		if err != nil || num < 0 || (len(part) > 1 && part[0] == '0') {
+			return nil, 0, fmt.Errorf("Semver: Invalid component '%v' in '%v'", part, orig)
+		}
+		*fields[i] = num
+		n++
+	}
+
+	if v.Pre != nil && n != 3 {
+		return nil, 0, fmt.Errorf("Semver: Pre-release on partial version '%v'", orig)
+	}
+
+	return v, n, nil
+}
+
+func (v *Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.Pre) > 0 {
+		s += "-" + strings.Join(v.Pre, ".")
+	}
+	return s
+}
+
+// Returns -1, 0 or 1 if v is lower than, equal to or higher than o.
+func (v *Version) Compare(o *Version) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d < 0 {
+			return -1
+		} else if d > 0 {
+			return 1
+		}
+	}
+
+	// A pre-release is lower than the release itself
+	if len(v.Pre) == 0 && len(o.Pre) == 0 {
+		return 0
+	} else if len(v.Pre) == 0 {
+		return 1
+	} else if len(o.Pre) == 0 {
+		return -1
+	}
+
+	for i := 0; i < len(v.Pre) && i < len(o.Pre); i++ {
+		if c := comparePreIdentifier(v.Pre[i], o.Pre[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInt(len(v.Pre), len(o.Pre))
+}
+
+// Numeric identifiers compare numerically and sort before alphanumeric ones.
+func comparePreIdentifier(a, b string) int {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		return compareInt(na, nb)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func compareInt(a, b int) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+type comparator struct {
+	op string
+	v  *Version
+}
+
+func (c comparator) check(v *Version) bool {
+	r := v.Compare(c.v)
+	switch c.op {
+	case "<":
+		return r < 0
+	case "<=":
+		return r <= 0
+	case ">":
+		return r > 0
+	case ">=":
+		return r >= 0
+	}
+	return r == 0
+}
+
+// A version range in the syntax used by npm: "^1.2.0", "~1.2", ">=1.0 <2",
+// "1.x" or "1.2 || 2". Comparators separated by spaces (or commas) must all
+// match, and "||" separates alternatives.
+type Constraint struct {
+	sets [][]comparator
+}
+
+func ParseConstraint(s string) (*Constraint, error) {
+	c := &Constraint{}
+	for _, alt := range strings.Split(s, "||") {
+		set := []comparator{}
+		fields := strings.FieldsFunc(alt, func(r rune) bool { return r == ' ' || r == ',' })
+		if len(fields) == 0 {
+			fields = []string{"*"}
+		}
+		for _, f := range fields {
+			cmps, err := parseComparator(f)
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, cmps...)
+		}
+		c.sets = append(c.sets, set)
+	}
+	return c, nil
+}
+
+// Desugar a single range term into plain comparators.
+func parseComparator(s string) ([]comparator, error) {
+	op := ""
+	for _, prefix := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(s, prefix) {
+			op = prefix
+			s = s[len(prefix):]
+			break
+		}
+	}
+
+	v, n, err := parsePartialVersion(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// The lowest version above the given components, ex. 1.2 -> 1.3.0
+	next := func(n int) *Version {
+		switch n {
+		case 0:
+			return nil
+		case 1:
+			return &Version{Major: v.Major + 1}
+		case 2:
+			return &Version{Major: v.Major, Minor: v.Minor + 1}
+		}
+		return &Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}
+	}
+	between := func(upper *Version) []comparator {
+		out := []comparator{{">=", v}}
+		if upper != nil {
+			out = append(out, comparator{"<", upper})
+		}
+		return out
+	}
+
+	switch op {
+	case "", "=":
+		if n == 3 {
+			return []comparator{{"=", v}}, nil
+		}
+		return between(next(n)), nil
+	case "~":
+		if n == 3 {
+			return between(next(2)), nil
+		}
+		return between(next(n)), nil
+	case "^":
+		// Allow changes that do not modify the left-most non-zero component
+		switch {
+		case n == 0:
+			return between(nil), nil
+		case v.Major != 0 || n == 1:
+			return between(next(1)), nil
+		case v.Minor != 0 || n == 2:
+			return between(next(2)), nil
+		}
+		return between(next(3)), nil
+	case ">":
+		if n == 0 {
+			return []comparator{{"<", &Version{}}}, nil
+		} else if n < 3 {
+			return []comparator{{">=", next(n)}}, nil
+		}
+	case "<=":
+		if n == 0 {
+			return between(nil), nil
+		} else if n < 3 {
+			return []comparator{{"<", next(n)}}, nil
+		}
+	case ">=":
+		if n == 0 {
+			return between(nil), nil
+		}
+	case "<":
+		if n == 0 {
+			return []comparator{{"<", &Version{}}}, nil
+		}
+	}
+	return []comparator{{op, v}}, nil
+}
+
+// Does the version satisfy the constraint? Pre-releases only match if one of
+// the comparators is a pre-release of the same major.minor.patch.
+func (c *Constraint) Check(v *Version) bool {
+	for _, set := range c.sets {
+		if checkSet(set, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkSet(set []comparator, v *Version) bool {
+	for _, cmp := range set {
+		if !cmp.check(v) {
+			return false
+		}
+	}
+	if len(v.Pre) == 0 {
+		return true
+	}
+	for _, cmp := range set {
+		if len(cmp.v.Pre) > 0 &&
+			cmp.v.Major == v.Major && cmp.v.Minor == v.Minor && cmp.v.Patch == v.Patch {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestVersionCompare(t *testing.T) {
+	// In ascending order
+	ordered := []string{
+		"0.0.1",
+		"0.1.0",
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"v1.0.0",
+		"1.2.10",
+		"10.0.0",
+	}
+
+	for i := range ordered {
+		for j := range ordered {
+			a, err := ParseVersion(ordered[i])
+			if err != nil {
+				t.Fatalf("ParseVersion(%v) failed: %v", ordered[i], err)
+			}
+			b, _ := ParseVersion(ordered[j])
+			if c := a.Compare(b); c != compareInt(i, j) {
+				t.Errorf("Expected %v.Compare(%v) to be %v, got %v", a, b, compareInt(i, j), c)
+			}
+		}
+	}
+
+	for _, in := range []string{"1", "1.2", "1.2.x", "01.2.3", "1.2.3.4", "1.2.3-", "foo"} {
+		if _, err := ParseVersion(in); err == nil {
+			t.Errorf("Expected ParseVersion(%v) to fail", in)
+		}
+	}
+}
+
+func TestConstraintCheck(t *testing.T) {
+	var tests = []struct {
+		c     string
+		match []string
+		miss  []string
+	}{
+		{"1.2.3", []string{"1.2.3", "v1.2.3"}, []string{"1.2.4", "1.2.3-rc1"}},
+		{"v1", []string{"1.0.0", "1.9.9"}, []string{"0.9.0", "2.0.0", "1.5.0-rc1"}},
+		{"1.x", []string{"1.0.0", "1.9.9"}, []string{"2.0.0"}},
+		{"1.2.*", []string{"1.2.0", "1.2.9"}, []string{"1.3.0"}},
+		{"*", []string{"0.0.0", "9.9.9"}, []string{"1.0.0-rc1"}},
+		{"^1.2.3", []string{"1.2.3", "1.9.0"}, []string{"1.2.2", "2.0.0", "2.0.0-rc1"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{"^0.x", []string{"0.0.0", "0.9.0"}, []string{"1.0.0"}},
+		{"~1.2.3", []string{"1.2.3", "1.2.9"}, []string{"1.3.0"}},
+		{"~1", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		{">=1.2 <2", []string{"1.2.0", "1.9.9"}, []string{"1.1.9", "2.0.0"}},
+		{">1.2", []string{"1.3.0"}, []string{"1.2.9"}},
+		{"<=1.2", []string{"1.2.9"}, []string{"1.3.0"}},
+		{">1.2.3,<1.3", []string{"1.2.4"}, []string{"1.2.3", "1.3.0"}},
+		{"^1.2.3-beta.2", []string{"1.2.3-beta.2", "1.2.3-beta.4", "1.2.3"}, []string{"1.2.3-beta.1", "1.2.4-beta.3"}},
+		{"1.0 || >=3", []string{"1.0.5", "3.1.0"}, []string{"2.0.0"}},
+	}
+
+	for _, tt := range tests {
+		c, err := ParseConstraint(tt.c)
+		if err != nil {
+			t.Errorf("ParseConstraint(%v) failed: %v", tt.c, err)
+			continue
+		}
+		for _, s := range tt.match {
+			if v, _ := ParseVersion(s); !c.Check(v) {
+				t.Errorf("Expected %v to satisfy %v", s, tt.c)
+			}
+		}
+		for _, s := range tt.miss {
+			if v, _ := ParseVersion(s); c.Check(v) {
+				t.Errorf("Expected %v not to satisfy %v", s, tt.c)
+			}
+		}
+	}
+
+	for _, in := range []string{"master", "^foo", ">=1.2.3.4", "1.x-rc1"} {
+		if _, err := ParseConstraint(in); err == nil {
+			t.Errorf("Expected ParseConstraint(%v) to fail", in)
+		}
+	}
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"html"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
 	"strings"
+	"time"
 )
 
 func copyHeaders(from, to http.Header) {
@@ -16,97 +23,544 @@ func copyHeaders(from, to http.Header) {
 	}
 }
 
-// One of the path elements will start and end with @. If we strip that element
-// out, we will get a path + tag/whatever.
-// ex: github.com/msiebuhr/@master/foo.git
-//
-// TODO: We should probably have a generic parser that results in (VCS, host,
-// commitish)
-func splitPathAndCommitish(path string) (string, string) {
-	parts := strings.Split(strings.Trim(path, "/"), "/")
-	c := ""
-	p_arr := make([]string, 0, len(parts))
+type Proxy struct {
+	config   *Config
+	hosts    *HostRegistry
+	client   *http.Client
+	cache    *RefsCache
+	mirrors  *Mirrors
+	versions *VersionLog
+	// For upstream; nil if there are none.
+	credentials *Credentials
+	// Who may use the proxy, and for what; nil if anyone may.
+	users *Users
+	acl   *ACL
+	// Which upstreams may be talked to.
+	policy *UpstreamPolicy
+}
+
+func NewProxy(c *Config) (*Proxy, error) {
+	hosts, err := c.HostRegistry()
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{config: c, hosts: hosts, client: &http.Client{
+		// The upstream policy has not checked where redirects lead, and
+		// credentials for upstream must not follow them
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return &PolicyError{fmt.Sprintf("upstream redirected to %v", req.URL.Redacted())}
+		},
+	}}
+	// Offline, no upstream is connected to
+	p.policy = NewUpstreamPolicy(c.UpstreamAllow, c.UpstreamDeny, c.AllowPrivateNetworks || c.Offline)
 
-	for _, part := range parts {
-		// .../@commitish/...
-		if strings.HasPrefix(part, "@") {
-			c = part
-		} else if strings.Contains(part, "@") {
-			subParts := strings.SplitN(part, "@", 2)
-			c = subParts[1]
-			p_arr = append(p_arr, subParts[0])
-		} else {
-			p_arr = append(p_arr, part)
+	if c.Htpasswd != "" || c.TokenFile != "" {
+		if p.users, err = LoadUsers(c.Htpasswd, c.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+	if c.ACL != "" {
+		if p.acl, err = LoadACL(c.ACL); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.Credentials) > 0 || c.Netrc != "" {
+		if p.credentials, err = NewCredentials(c.Credentials, c.Netrc); err != nil {
+			return nil, err
 		}
 	}
 
-	return strings.Join(p_arr, "/"), strings.Trim(c, "@")
-}
+	// Offline, nothing but the mirrors may answer
+	var upstream http.RoundTripper = &authTransport{
+		credentials: p.credentials,
+		passthrough: c.AuthPassthrough,
+		next:        p.policy.Transport(),
+	}
+	p.client.Transport = upstream
+	if c.Offline {
+		upstream = offlineTransport{}
+		p.client.Transport = upstream
+	}
 
-func main() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println(r.URL.Path)
-		// Is it a go-get request? And why should I care?
-
-		// TODO: Check upstream exists!
-		w.WriteHeader(200)
-		w.Write([]byte("<html><head>\n"))
-		fmt.Fprintf(
-			w,
-			"<meta name=\"go-import\" content=\"127.0.0.1:8080%s git http://127.0.0.1:8080/_git%s\"></meta>\n",
-			r.URL.Path,
-			r.URL.Path,
-		)
-		w.Write([]byte("</head><body>foobar</body></html>"))
-	})
+	if c.MirrorDir != "" {
+		if p.mirrors, err = NewMirrors(c.MirrorDir, c.MirrorRefresh.Duration, upstream); err != nil {
+			return nil, err
+		}
+		p.mirrors.offline = c.Offline
+		p.mirrors.credentials = p.credentials
+		p.mirrors.policy = p.policy
+		p.client.Transport = p.mirrors
+	}
+	if c.CacheDir != "" {
+		if p.cache, err = NewRefsCache(c.CacheDir, c.CacheTTL.Duration, c.CacheStale.Duration); err != nil {
+			return nil, err
+		}
+		p.cache.offline = c.Offline
+	}
+	if c.VersionLog != "" {
+		if p.versions, err = OpenVersionLog(c.VersionLog, c.VersionPolicy); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
 
+// Returns a mux with all of the proxy's handlers registered.
+func (p *Proxy) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", p.serveMeta)
 	// Magic GIT imports
-	http.HandleFunc("/_git/github.com/", func(w http.ResponseWriter, r *http.Request) {
-		path, commitish := splitPathAndCommitish(strings.TrimPrefix(r.URL.Path, "/_git"))
-		baseUrl := fmt.Sprintf("https://%s", path)
-		fullUrl := baseUrl
-		if r.URL.RawQuery != "" {
-			fullUrl = fmt.Sprintf("%v?%v", baseUrl, r.URL.RawQuery)
+	mux.HandleFunc("/_git/", p.serveGit)
+	mux.HandleFunc("/_api/resolve", p.serveResolve)
+	if p.users != nil {
+		return p.users.Handler(mux)
+	}
+	return mux
+}
+
+// Parse the request path, answering with a 404 for unknown hosts and a 400
+// for paths that make no sense.
+func (p *Proxy) parseImportPath(w http.ResponseWriter, r *http.Request, escaped string) (*ImportPath, bool) {
+	ip, err := p.hosts.ParseImportPath(escaped)
+	if err == ErrUnknownHost {
+		http.NotFound(w, r)
+		return nil, false
+	} else if err != nil {
+		http.Error(w, err.Error(), 400)
+		return nil, false
+	}
+	return ip, true
+}
+
+// Check the request's user may use the repository and that the upstream
+// policy lets the proxy fetch it.
+func (p *Proxy) checkAccess(r *http.Request, ip *ImportPath) error {
+	user := requestUser(r)
+	if p.acl != nil && !p.acl.Allowed(user, ip.Root()) {
+		if user == "" {
+			user = "anonymous"
 		}
+		return &PolicyError{fmt.Sprintf("%v may not access %v", user, ip.Root())}
+	}
+	return p.policy.Check(ip.Root(), ip.Host.RepoURL(ip.Repo))
+}
+
+func (p *Proxy) serveMeta(w http.ResponseWriter, r *http.Request) {
+	fmt.Println(r.URL.Path)
+	if isModuleRequest(r.URL.Path) {
+		p.serveModule(w, r)
+		return
+	}
 
-		fmt.Println(fullUrl, commitish)
+	ip, ok := p.parseImportPath(w, r, r.URL.EscapedPath())
+	if !ok {
+		return
+	}
+	if err := p.checkAccess(r, ip); err != nil {
+		log.Printf("Meta: Refused %v: %v", ip, err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	// Browsers get the versions there are
+	if r.URL.Query().Get("go-get") != "1" {
+		p.serveVersions(w, r, ip)
+		return
+	}
 
-		// Create a new request and send it off
-		client := &http.Client{}
-		req, _ := http.NewRequest(r.Method, fullUrl, r.Body)
-		copyHeaders(r.Header, req.Header)
-		res, err := client.Do(req)
+	// TODO: Check upstream exists!
+	// The repository root, not the package asked for, goes in the meta tag
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(200)
+	w.Write([]byte("<!DOCTYPE html>\n<html><head>\n"))
+	fmt.Fprintln(w, p.config.GoImportMeta("/"+ip.VersionedRoot()))
+	fmt.Fprintf(w, "</head><body>go get %s</body></html>\n", html.EscapeString(p.config.Host+"/"+ip.String()))
+}
+
+func (p *Proxy) serveGit(w http.ResponseWriter, r *http.Request) {
+	ip, err := p.hosts.ParseImportPath(strings.TrimPrefix(r.URL.EscapedPath(), "/_git"))
+	if err == ErrUnknownHost {
+		writeGitError(w, r, 404, "unknown host in "+r.URL.Path)
+		return
+	} else if err != nil {
+		writeGitError(w, r, 400, err.Error())
+		return
+	}
+	if err := p.checkAccess(r, ip); err != nil {
+		p.writeGitFailure(w, r, ip, err)
+		return
+	}
+	host, repo, path, commitish := ip.Host, ip.Repo, ip.Subpath, ip.Commitish
+
+	baseUrl := host.RepoURL(repo)
+	if path != "" {
+		baseUrl = fmt.Sprintf("%s/%s", baseUrl, (&url.URL{Path: path}).EscapedPath())
+	}
+	fullUrl := baseUrl
+	if r.URL.RawQuery != "" {
+		fullUrl = fmt.Sprintf("%v?%v", baseUrl, r.URL.RawQuery)
+	}
+
+	fmt.Println(fullUrl, commitish)
+
+	// Check what the client wants, and rewrite protocol v2's ls-refs to
+	// fetch all refs
+	var reqBody io.Reader = r.Body
+	var lsRefs *gitCommandV2
+	var upload *uploadPackRequest
+	var pinned *GitUploadPack
+	if r.Method == "POST" && strings.HasSuffix(path, "git-upload-pack") {
+		buf, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			//fmt.Println(err)
-			http.Error(w, fmt.Sprintf("Proxy error: %v", err), 500)
+			writeGitError(w, r, 400, fmt.Sprintf("Reading request: %v", err))
 			return
 		}
+		reqBody = bytes.NewReader(buf)
 
-		// If if it is an info/refs thing, then we want to modify the body before it goes back
-		if strings.HasSuffix(path, "info/refs") {
-			body, _ := parseGitUploadPack(res.Body)
-
-			err := body.SetMaster(commitish)
-
+		var command *gitCommandV2
+		upload, command, err = parseUploadPackPost(r.Header, buf)
+		if err != nil {
+			writeGitError(w, r, 400, err.Error())
+			return
+		}
+		if command != nil && command.command == "ls-refs" {
+			lsRefs = command
+			reqBody = strings.NewReader(command.upstreamLsRefs().String())
+			r.Header.Del("Content-Encoding")
+		}
+		if upload != nil && commitish != "" {
+			pinned, err = p.fetchAdvertisement(host.RepoURL(repo), r.Header, commitish)
 			if err != nil {
-				fmt.Println("ERROR:", err)
-				w.WriteHeader(404)
+				p.writeGitFailure(w, r, ip, err)
 				return
 			}
+			if err := upload.validate(pinned); err != nil {
+				writeGitError(w, r, 400, err.Error())
+				return
+			}
+		}
+	}
 
-			// Send back response headers
-			copyHeaders(res.Header, w.Header())
-			w.WriteHeader(res.StatusCode)
+	// Answer ref listings from the cache if we have one. Protocol v2 clients
+	// get the cached v0 advertisement too, and fall back to v0.
+	isInfoRefs := strings.HasSuffix(path, "info/refs") && r.URL.Query().Get("service") == "git-upload-pack"
+	if p.cache != nil && (lsRefs != nil || isInfoRefs) {
+		p.serveCachedRefs(w, r, ip, lsRefs)
+		return
+	}
 
-			w.Write([]byte(body.String()))
-			//w.Close()
-		} else {
-			// Copy over response
+	// Create a new request and send it off
+	req, _ := http.NewRequest(r.Method, fullUrl, reqBody)
+	copyHeaders(r.Header, req.Header)
+	res, err := p.client.Do(req)
+	if err != nil {
+		p.writeGitFailure(w, r, ip, err)
+		return
+	}
+	defer res.Body.Close()
+
+	// If if it is an info/refs thing, then we want to modify the body before it goes back
+	if strings.HasSuffix(path, "info/refs") {
+		// Git asks for credentials on a 401, so those go back as they are
+		if res.StatusCode != 200 && res.StatusCode != 401 {
+			p.writeGitFailure(w, r, ip, &UpstreamError{res.StatusCode, res.Status, res.Header})
+			return
+		}
+		buf, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			p.writeGitFailure(w, r, ip, err)
+			return
+		}
+
+		// A v2 capability advertisement has no refs; they come with ls-refs
+		if res.StatusCode == 401 || isProtocolV2Advertisement(buf) {
 			copyHeaders(res.Header, w.Header())
 			w.WriteHeader(res.StatusCode)
-			io.Copy(w, res.Body)
+			w.Write(buf)
+			return
+		}
+
+		body, err := parseGitUploadPack(ioutil.NopCloser(bytes.NewReader(buf)))
+		if err != nil {
+			p.writeGitFailure(w, r, ip, fmt.Errorf("Invalid upstream advertisement: %v", err))
+			return
+		}
+		if err := p.pin(body, host.RepoURL(repo), commitish); err != nil {
+			p.writeGitFailure(w, r, ip, err)
+			return
+		}
+
+		// Send back response headers
+		copyHeaders(res.Header, w.Header())
+		w.Header().Del("Content-Length")
+		w.WriteHeader(res.StatusCode)
+
+		w.Write([]byte(body.String()))
+		//w.Close()
+	} else if lsRefs != nil && res.StatusCode == 200 {
+		body, err := parseLsRefs(res.Body)
+		if err != nil {
+			p.writeGitFailure(w, r, ip, fmt.Errorf("Invalid upstream ls-refs: %v", err))
+			return
+		}
+		if err := p.pin(body, host.RepoURL(repo), commitish); err != nil {
+			p.writeGitFailure(w, r, ip, err)
+			return
 		}
-	})
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+		copyHeaders(res.Header, w.Header())
+		w.Header().Del("Content-Length")
+		w.WriteHeader(res.StatusCode)
+		w.Write([]byte(body.LsRefs(lsRefs)))
+	} else if pinned != nil && upload.sideBandMax > 0 && !upload.noProgress &&
+		res.StatusCode == 200 && res.Header.Get("Content-Encoding") == "" {
+		// Tell the user which version they are getting
+		copyHeaders(res.Header, w.Header())
+		w.Header().Del("Content-Length")
+		w.WriteHeader(res.StatusCode)
+		msg := fmt.Sprintf("pinned to %s by git-version-proxy", pinned.PinnedTo())
+		if err := injectProgress(w, res.Body, wantsProtocolV2(r.Header), upload.sideBandMax, msg); err != nil {
+			log.Printf("Git: Cannot send %v: %v", ip, err)
+		}
+	} else {
+		// Copy over response
+		copyHeaders(res.Header, w.Header())
+		w.WriteHeader(res.StatusCode)
+		io.Copy(w, res.Body)
+	}
+}
+
+// Answer an info/refs GET or a protocol v2 ls-refs from the cache.
+func (p *Proxy) serveCachedRefs(w http.ResponseWriter, r *http.Request, ip *ImportPath, lsRefs *gitCommandV2) {
+	adv, err := p.fetchAdvertisement(ip.Host.RepoURL(ip.Repo), r.Header, ip.Commitish)
+	if err != nil {
+		p.writeGitFailure(w, r, ip, err)
+		return
+	}
+
+	if lsRefs != nil {
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+		w.Write([]byte(adv.LsRefs(lsRefs)))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(adv.String()))
+}
+
+// Returned when upstream answers with something other than 200 OK.
+type UpstreamError struct {
+	StatusCode int
+	Status     string
+	Header     http.Header
+}
+
+func (e *UpstreamError) Error() string {
+	return "Upstream returned " + e.Status
+}
+
+// Fetch the raw v0 info/refs advertisement of an upstream repository.
+func (p *Proxy) fetchRefs(repoUrl string, h http.Header) ([]byte, error) {
+	req, err := http.NewRequest("GET", repoUrl+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		return nil, err
+	}
+	copyHeaders(h, req.Header)
+	for _, header := range []string{"Git-Protocol", "Content-Type", "Content-Encoding", "Accept", "Accept-Encoding"} {
+		req.Header.Del(header)
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, &UpstreamError{res.StatusCode, res.Status, res.Header}
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// The parsed advertisement of an upstream repository, from the cache if
+// there is one. What upstream shows a client passing its own credentials is
+// for that client alone, so it is never cached; everything else is fetched
+// without the client's credentials, as it is shared by all clients.
+func (p *Proxy) advertisement(repoUrl string, h http.Header) (*GitUploadPack, error) {
+	var body []byte
+	var err error
+	fetched := time.Now()
+	if p.cache != nil && !(p.config.AuthPassthrough && h.Get("Authorization") != "") {
+		shared := h.Clone()
+		shared.Del("Authorization")
+		shared.Del("Cookie")
+		body, fetched, err = p.cache.Get(repoUrl, func() ([]byte, error) { return p.fetchRefs(repoUrl, shared) })
+	} else {
+		body, err = p.fetchRefs(repoUrl, h)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	adv, err := parseGitUploadPack(ioutil.NopCloser(bytes.NewReader(body)))
+	if err != nil {
+		return nil, err
+	}
+	adv.fetched = fetched
+	return adv, nil
+}
+
+// The advertisement of an upstream repository pinned to the given
+// commitish, as a client would see it.
+func (p *Proxy) fetchAdvertisement(repoUrl string, h http.Header, commitish string) (*GitUploadPack, error) {
+	adv, err := p.advertisement(repoUrl, h)
+	if err != nil {
+		return nil, err
+	}
+	return adv, p.pin(adv, repoUrl, commitish)
+}
+
+// Pin an advertisement to the given commitish. Tags are checked against the
+// version log, if there is one.
+func (p *Proxy) pin(adv *GitUploadPack, repoUrl, commitish string) error {
+	// What upstream hands out, before pinning points refs elsewhere
+	var upstream map[string]bool
+	if p.versions != nil {
+		upstream = adv.advertisedCommits()
+	}
+	adv.OnlyPinned = p.config.OnlyPinned
+	if err := adv.SetMaster(commitish); err != nil {
+		return err
+	}
+	if p.versions == nil || adv.pinnedRef == "" {
+		return nil
+	}
+	current := adv.peeled(adv.pinnedRef)
+	commit, err := p.versions.Check(repoUrl, adv.pinnedRef, current)
+	if err != nil {
+		return err
+	}
+	// Clients can only fetch a kept commit upstream still advertises
+	if commit != current && !upstream[commit] {
+		return &TagMovedError{Ref: adv.pinnedRef, Recorded: commit, Current: current}
+	}
+	adv.repinTag(commit)
+	return nil
+}
+
+// How a failure to serve a repository or version should be answered.
+func errorStatus(err error) int {
+	var policy *PolicyError
+	var ambiguous *AmbiguousCommitishError
+	var moved *TagMovedError
+	var upstream *UpstreamError
+	switch {
+	case errors.As(err, &policy):
+		return 403
+	case errors.Is(err, ErrCommitishNotFound), errors.Is(err, ErrOffline),
+		errors.As(err, &ambiguous), errors.As(err, &moved):
+		return 404
+	case errors.As(err, &upstream) && (upstream.StatusCode == 401 || upstream.StatusCode == 404):
+		return upstream.StatusCode
+	}
+	return 502
+}
+
+// Tell a git client why a repository or version cannot be served.
+func (p *Proxy) writeGitFailure(w http.ResponseWriter, r *http.Request, ip *ImportPath, err error) {
+	log.Printf("Git: Cannot serve %v: %v", ip, err)
+	status := errorStatus(err)
+	var upstream *UpstreamError
+	if status == 401 && errors.As(err, &upstream) {
+		w.Header().Set("WWW-Authenticate", upstream.Header.Get("WWW-Authenticate"))
+		http.Error(w, "Authentication required", 401)
+		return
+	}
+	msg := fmt.Sprintf("%s: %v", ip.VersionedRoot(), err)
+	switch {
+	case p.config.Offline && status == 404:
+		msg = fmt.Sprintf("%s is not in the offline store", ip.VersionedRoot())
+	case errors.Is(err, ErrCommitishNotFound):
+		msg = fmt.Sprintf("version %s not found in %s", ip.Commitish, ip.Root())
+	case errors.As(err, &upstream) && status == 404:
+		msg = fmt.Sprintf("repository %s not found", ip.Root())
+	}
+	writeGitError(w, r, status, msg)
+}
+
+// Send an error git clients will display as "remote error: <msg>": an ERR
+// pkt-line in an advertisement, in reply to an info/refs GET, or a
+// git-upload-pack result. Git only reads the body of a 200, so it gets one;
+// other clients get the real status.
+func writeGitError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if strings.HasPrefix(r.UserAgent(), "git/") {
+		status = 200
+	}
+	pw := NewPktWriter(w)
+	if strings.HasSuffix(r.URL.Path, "/info/refs") {
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(status)
+		pw.WriteString("# service=git-upload-pack\n")
+		pw.Flush()
+	} else {
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+		w.WriteHeader(status)
+	}
+	pw.WriteString(fmt.Sprintf("ERR %s\n", msg))
+}
+
+// A local repository with the given commit: the mirror if there is one and
+// it has the commit, otherwise a temporary fetch of just that commit.
+func (p *Proxy) localCommit(repoUrl, commit string) (*localRepo, error) {
+	if p.mirrors != nil {
+		if local, err := p.mirrors.get(repoUrl); err == nil && local.has(commit) {
+			return local, nil
+		}
+	}
+	if p.config.Offline {
+		return nil, ErrOffline
+	}
+	return fetchCommit(repoUrl, commit, p.credentials, p.policy)
+}
+
+// A local repository with the commit an abbreviated SHA names, which need not
+// be the tip of any ref, and the full SHA: the mirror if there is one and it
+// has the commit, otherwise a temporary fetch of all branches and tags.
+func (p *Proxy) localAbbrevCommit(repoUrl, abbrev string) (*localRepo, string, error) {
+	if p.mirrors != nil {
+		if local, err := p.mirrors.get(repoUrl); err == nil {
+			if commit, err := local.resolveCommit(abbrev); err == nil {
+				return local, commit, nil
+			}
+		}
+	}
+	if p.config.Offline {
+		return nil, "", ErrOffline
+	}
+	local, err := fetchHistory(repoUrl, p.credentials, p.policy)
+	if err != nil {
+		return nil, "", err
+	}
+	commit, err := local.resolveCommit(abbrev)
+	if err != nil {
+		local.Remove()
+		return nil, "", ErrCommitishNotFound
+	}
+	return local, commit, nil
+}
+
+func main() {
+	config, err := parseFlags(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proxy, err := NewProxy(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Listening on %v, serving as %v", config.Listen, config.BaseURL())
+	log.Fatal(http.ListenAndServe(config.Listen, proxy.Handler()))
 }
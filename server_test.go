@@ -1,29 +1,150 @@
 package main
 
 import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
-func TestSplitPathAndCommitish(t *testing.T) {
+// Start a fake upstream serving the given info/refs advertisement, and a proxy
+// with "git.example.com" pointed at it.
+func newTestProxy(t *testing.T, advertisement string) (*Proxy, *httptest.Server) {
+	return newTestProxyWithUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/info/refs"):
+			w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+			io.WriteString(w, advertisement)
+		case strings.HasSuffix(r.URL.Path, "/git-upload-pack") && r.Method == "POST":
+			w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+			io.WriteString(w, "0008NAK\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func newTestProxyWithUpstream(t *testing.T, h http.Handler) (*Proxy, *httptest.Server) {
+	upstream := httptest.NewServer(h)
+
+	c := NewConfig()
+	c.Hosts = []*Host{{Name: "git.example.com", URL: upstream.URL + "/{repo}", RootDepth: 2}}
+	c.AllowPrivateNetworks = true
+	p, err := NewProxy(c)
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	return p, upstream
+}
+
+var testAdvertisement = "001e# service=git-upload-pack\n0000" +
+	writePktLine("c7d3d3371baa35587fb66d8a79c6d999a4dafd8e HEAD\000multi_ack side-band-64k ofs-delta\n") +
+	writePktLine("c7d3d3371baa35587fb66d8a79c6d999a4dafd8e refs/heads/master\n") +
+	writePktLine("48da4910b78e24d8d3a831839cc751700ddc6e10 refs/heads/update-docs\n") +
+	"0000"
+
+func TestServeGitHosts(t *testing.T) {
+	p, upstream := newTestProxy(t, testAdvertisement)
+	defer upstream.Close()
+
+	var tests = []struct {
+		path   string
+		status int
+	}{
+		{"/_git/git.example.com/foo/bar@update-docs/info/refs?service=git-upload-pack", 200},
+		{"/_git/git.example.com/foo/bar@master/info/refs?service=git-upload-pack", 200},
+		{"/_git/git.example.com/foo/bar/@master/info/refs?service=git-upload-pack", 200},
+		{"/_git/unknown.example.com/foo/bar@master/info/refs?service=git-upload-pack", 404},
+		{"/git.example.com/foo/bar@master?go-get=1", 200},
+		{"/unknown.example.com/foo/bar@master?go-get=1", 404},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		p.Handler().ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("Expected GET %v to give %v, got %v", tt.path, tt.status, w.Code)
+		}
+	}
+}
+
+func TestServeMeta(t *testing.T) {
+	p, upstream := newTestProxy(t, testAdvertisement)
+	defer upstream.Close()
+	p.config.Host = "go.example.com"
+
+	var tests = []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/git.example.com/foo/bar@v1/sub/pkg?go-get=1", 200, `<meta name="go-import" content="go.example.com/git.example.com/foo/bar@v1 git http://go.example.com/_git/git.example.com/foo/bar@v1"></meta>`},
+		{"/git.example.com/foo/bar/@master/sub?go-get=1", 200, `<meta name="go-import" content="go.example.com/git.example.com/foo/bar/@master git http://go.example.com/_git/git.example.com/foo/bar/@master"></meta>`},
+		{"/git.example.com/foo/bar/sub?go-get=1", 200, `<meta name="go-import" content="go.example.com/git.example.com/foo/bar git http://go.example.com/_git/git.example.com/foo/bar"></meta>`},
+		{"/git.example.com/foo/bar@%5E1.0/sub?go-get=1", 200, `content="go.example.com/git.example.com/foo/bar@^1.0 git`},
+		{"/git.example.com/foo/bar@master/sub/pkg", 200, "<title>git.example.com/foo/bar</title>"},
+		{"/git.example.com/foo?go-get=1", 400, ""},
+		{"/favicon.ico", 404, ""},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		p.Handler().ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("GET %v: Expected %v containing %q, got %v %q", tt.path, tt.status, tt.body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestServeGitErrors(t *testing.T) {
+	p, upstream := newTestProxyWithUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/foo/bar/info/refs":
+			io.WriteString(w, testAdvertisement)
+		case "/foo/broken/info/refs":
+			io.WriteString(w, "<html>Oops</html>")
+		case "/foo/down/info/refs":
+			http.Error(w, "Down for maintenance", 503)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
 	var tests = []struct {
-		in string
-		op string
-		oc string
+		method string
+		path   string
+		status int
+		err    string
 	}{
-		{"/github.com/foo/@master/bar.git", "github.com/foo/bar.git", "master"},
-		{"/github.com/foo/bar.git/@master", "github.com/foo/bar.git", "master"},
-		{"/github.com/foo/bar@master", "github.com/foo/bar", "master"},
-		{"/github.com/coreos/etcd@v0.1.0", "github.com/coreos/etcd", "v0.1.0"},
+		{"GET", "/_git/git.example.com/foo/bar@v9.9/info/refs?service=git-upload-pack", 404, "version v9.9 not found in git.example.com/foo/bar"},
+		{"POST", "/_git/git.example.com/foo/bar@v9.9/git-upload-pack", 404, "version v9.9 not found in git.example.com/foo/bar"},
+		{"GET", "/_git/git.example.com/foo/missing/info/refs?service=git-upload-pack", 404, "repository git.example.com/foo/missing not found"},
+		{"GET", "/_git/git.example.com/foo/broken@master/info/refs?service=git-upload-pack", 502, "git.example.com/foo/broken@master: Invalid upstream advertisement"},
+		{"GET", "/_git/git.example.com/foo/down/info/refs?service=git-upload-pack", 502, "git.example.com/foo/down: Upstream returned 503 Service Unavailable"},
+		{"GET", "/_git/git.example.com/foo@master/bar/info/refs?service=git-upload-pack", 400, "ImportPath: @version must follow the repository"},
 	}
 
 	for _, tt := range tests {
-		p, c := splitPathAndCommitish(tt.in)
+		body := writePktLine("want c7d3d3371baa35587fb66d8a79c6d999a4dafd8e\n") + "0000" + writePktLine("done\n")
+		for _, userAgent := range []string{"curl/8.0", "git/2.43.0"} {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(body))
+			r.Header.Set("User-Agent", userAgent)
+			w := httptest.NewRecorder()
+			p.Handler().ServeHTTP(w, r)
 
-		if p != tt.op || c != tt.oc {
-			t.Errorf(
-				"Expected %v to have path %v and commitish %v, got %v and %v",
-				tt.in, tt.op, tt.oc, p, c,
-			)
+			// Git only shows the message with a 200
+			status := tt.status
+			if userAgent != "curl/8.0" {
+				status = 200
+			}
+			if w.Code != status || !strings.Contains(w.Body.String(), "ERR "+tt.err) {
+				t.Errorf("%v %v as %v: Expected %v %q, got %v %q", tt.method, tt.path, userAgent, status, tt.err, w.Code, w.Body.String())
+			}
+			if tt.method == "GET" && !strings.HasPrefix(w.Body.String(), "001e# service=git-upload-pack\n0000") {
+				t.Errorf("GET %v: Expected an advertisement, got %q", tt.path, w.Body.String())
+			}
 		}
 	}
 }
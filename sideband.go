@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// Side-band channels, see "side-band" in git's protocol-capabilities docs.
+const (
+	SideBandData     byte = 1
+	SideBandProgress byte = 2
+	SideBandError    byte = 3
+)
+
+// Largest side-band payloads (excluding the channel byte) for the side-band
+// and side-band-64k capabilities.
+const (
+	SideBandMax    = 1000 - 5
+	SideBand64kMax = MaxPktLen - 5
+)
+
+// Reads multiplexed side-band packets up to the terminating flush.
+type SideBandReader struct {
+	r *PktReader
+}
+
+func NewSideBandReader(r *PktReader) *SideBandReader {
+	return &SideBandReader{r: r}
+}
+
+// Read the next packet, returning its channel and payload. Returns io.EOF at
+// the terminating flush.
+func (r *SideBandReader) ReadBand() (byte, []byte, error) {
+	pkt, err := r.r.ReadPkt()
+	if err == io.EOF {
+		return 0, nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return 0, nil, err
+	}
+
+	switch {
+	case pkt.Type == PktFlush:
+		return 0, nil, io.EOF
+	case pkt.Type != PktData || len(pkt.Data) == 0:
+		return 0, nil, fmt.Errorf("SideBand: Unexpected packet")
+	case pkt.Data[0] < SideBandData || pkt.Data[0] > SideBandError:
+		return 0, nil, fmt.Errorf("SideBand: Unknown channel %v", pkt.Data[0])
+	}
+	return pkt.Data[0], pkt.Data[1:], nil
+}
+
+// Copy pack data and progress messages to the given writers (either may be
+// nil) until the terminating flush. A message on the error channel is
+// returned as an error.
+func (r *SideBandReader) Demux(pack, progress io.Writer) error {
+	for {
+		channel, data, err := r.ReadBand()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var w io.Writer
+		switch channel {
+		case SideBandData:
+			w = pack
+		case SideBandProgress:
+			w = progress
+		case SideBandError:
+			return fmt.Errorf("remote error: %s", data)
+		}
+		if w != nil {
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Writes multiplexed side-band packets.
+type SideBandWriter struct {
+	w   *PktWriter
+	max int
+}
+
+// Create a writer splitting payloads into chunks of at most max bytes; one of
+// SideBandMax or SideBand64kMax.
+func NewSideBandWriter(w *PktWriter, max int) *SideBandWriter {
+	return &SideBandWriter{w: w, max: max}
+}
+
+func (w *SideBandWriter) WriteBand(channel byte, data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > w.max {
+			n = w.max
+		}
+		if err := w.w.WritePkt(append([]byte{channel}, data[:n]...)); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// Send a progress message; git prints it as "remote: <msg>".
+func (w *SideBandWriter) Progress(msg string) error {
+	return w.WriteBand(SideBandProgress, []byte(msg+"\n"))
+}
+
+// Copy a git-upload-pack response from src to dst, adding a progress message
+// right before the side-band multiplexed pack data starts. For protocol v2
+// that is after the "packfile" line; for v0 after the ACK/NAK lines.
+func injectProgress(dst io.Writer, src io.Reader, v2 bool, max int, msg string) error {
+	r := NewPktReader(src)
+	w := NewPktWriter(dst)
+
+	for {
+		pkt, err := r.ReadPkt()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		sideBand := !v2 && pkt.Type == PktData && len(pkt.Data) > 0 &&
+			pkt.Data[0] >= SideBandData && pkt.Data[0] <= SideBandError
+		if sideBand {
+			if err := NewSideBandWriter(w, max).Progress(msg); err != nil {
+				return err
+			}
+		}
+
+		if err := w.WritePacket(pkt); err != nil {
+			return err
+		}
+
+		if v2 && pkt.Type == PktData && string(pkt.Data) == "packfile\n" {
+			if err := NewSideBandWriter(w, max).Progress(msg); err != nil {
+				return err
+			}
+			sideBand = true
+		}
+
+		// The rest is passed through untouched
+		if sideBand {
+			_, err := io.Copy(dst, src)
+			return err
+		}
+	}
+}
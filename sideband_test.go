@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSideBandDemux(t *testing.T) {
+	in := writePktLine("\x01PACK") +
+		writePktLine("\x02Counting objects: 3\r") +
+		writePktLine("\x01data") +
+		"0000"
+
+	var pack, progress bytes.Buffer
+	err := NewSideBandReader(NewPktReader(strings.NewReader(in))).Demux(&pack, &progress)
+	if err != nil {
+		t.Fatalf("Demux failed: %v", err)
+	}
+	if pack.String() != "PACKdata" || progress.String() != "Counting objects: 3\r" {
+		t.Errorf("Unexpected pack %q and progress %q", pack.String(), progress.String())
+	}
+
+	in = writePktLine("\x01PACK") + writePktLine("\x03upload-pack: not our ref") + "0000"
+	err = NewSideBandReader(NewPktReader(strings.NewReader(in))).Demux(nil, nil)
+	if err == nil || err.Error() != "remote error: upload-pack: not our ref" {
+		t.Errorf("Expected remote error, got %v", err)
+	}
+
+	in = writePktLine("\x05huh") + "0000"
+	if err = NewSideBandReader(NewPktReader(strings.NewReader(in))).Demux(nil, nil); err == nil {
+		t.Errorf("Expected unknown channel to fail")
+	}
+}
+
+func TestSideBandWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewSideBandWriter(NewPktWriter(&buf), SideBandMax)
+
+	data := bytes.Repeat([]byte("x"), SideBandMax+10)
+	if err := w.WriteBand(SideBandData, data); err != nil {
+		t.Fatalf("WriteBand failed: %v", err)
+	}
+
+	r := NewSideBandReader(NewPktReader(&buf))
+	for _, exp := range []int{SideBandMax, 10} {
+		channel, got, err := r.ReadBand()
+		if err != nil || channel != SideBandData || len(got) != exp {
+			t.Errorf("Expected %v bytes on channel 1, got %v on %v (%v)", exp, len(got), channel, err)
+		}
+	}
+}
+
+func TestInjectProgress(t *testing.T) {
+	pack := writePktLine("\x01PACK") + writePktLine("\x02Total 3\n") + "0000"
+	msg := writePktLine("\x02pinned to v1 (abc1234) by git-version-proxy\n")
+
+	var tests = []struct {
+		v2  bool
+		in  string
+		out string
+	}{
+		{false, "0008NAK\n" + pack, "0008NAK\n" + msg + pack},
+		{
+			true,
+			writePktLine("acknowledgments\n") + writePktLine("NAK\n") + "0001" + writePktLine("packfile\n") + pack,
+			writePktLine("acknowledgments\n") + writePktLine("NAK\n") + "0001" + writePktLine("packfile\n") + msg + pack,
+		},
+		// Nothing to add to if there is no pack
+		{false, "0008NAK\n", "0008NAK\n"},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		err := injectProgress(&out, strings.NewReader(tt.in), tt.v2, SideBand64kMax, "pinned to v1 (abc1234) by git-version-proxy")
+		if err != nil {
+			t.Errorf("injectProgress failed: %v", err)
+		} else if out.String() != tt.out {
+			t.Errorf("Expected\n%q\nGot\n%q", tt.out, out.String())
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Returned when the upstream policy forbids talking to a repository.
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return "Forbidden: " + e.Reason
+}
+
+// Which upstream repositories the proxy may talk to. Repositories ("host/
+// owner/repo") matching a deny pattern are refused, as are those not matching
+// any allow pattern if there are any; patterns are as in ACL files. Unless
+// private networks are allowed, upstreams resolving to loopback, private or
+// link-local addresses are refused too. The proxy checks each connection it
+// makes, and git is told which checked address to connect to, so DNS cannot be
+// used to sneak around it. Neither follows redirects.
+type UpstreamPolicy struct {
+	allow        []*regexp.Regexp
+	deny         []*regexp.Regexp
+	allowPrivate bool
+}
+
+func NewUpstreamPolicy(allow, deny []string, allowPrivate bool) *UpstreamPolicy {
+	p := &UpstreamPolicy{allowPrivate: allowPrivate}
+	for _, pattern := range allow {
+		p.allow = append(p.allow, compileACLPattern(pattern))
+	}
+	for _, pattern := range deny {
+		p.deny = append(p.deny, compileACLPattern(pattern))
+	}
+	return p
+}
+
+// Path segments of repositories: no empty, "." or ".." segments and nothing
+// that means something in a URL.
+var repoSegment = regexp.MustCompile(`^[A-Za-z0-9_.~-]+$`)
+
+// Check that a repository, ex. "github.com/user/repo", may be fetched from the
+// given upstream URL.
+func (p *UpstreamPolicy) Check(repo, repoUrl string) error {
+	for _, segment := range strings.Split(repo, "/") {
+		if !repoSegment.MatchString(segment) || segment == "." || segment == ".." {
+			return &PolicyError{fmt.Sprintf("%v is not a valid repository path", repo)}
+		}
+	}
+	for _, re := range p.deny {
+		if re.MatchString(repo) {
+			return &PolicyError{fmt.Sprintf("%v is denied", repo)}
+		}
+	}
+	if len(p.allow) > 0 {
+		allowed := false
+		for _, re := range p.allow {
+			allowed = allowed || re.MatchString(repo)
+		}
+		if !allowed {
+			return &PolicyError{fmt.Sprintf("%v is not allowed", repo)}
+		}
+	}
+
+	if p.allowPrivate {
+		return nil
+	}
+	// Refused now rather than on connecting, for a clearer error
+	_, err := p.gitResolve(repoUrl)
+	return err
+}
+
+// Look up the host of an upstream URL and check every address it resolves
+// to. Returns git's http.curloptResolve setting pinning the host to the first
+// one, ex. "github.com:443:140.82.121.3", or nothing if private networks are
+// allowed or the host is an IP address.
+func (p *UpstreamPolicy) gitResolve(repoUrl string) (string, error) {
+	if p == nil || p.allowPrivate {
+		return "", nil
+	}
+	u, err := url.Parse(repoUrl)
+	if err != nil {
+		return "", err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), u.Hostname())
+	if err != nil {
+		return "", err
+	} else if len(ips) == 0 {
+		return "", fmt.Errorf("%v has no addresses", u.Hostname())
+	}
+	for _, ip := range ips {
+		if err := checkIP(ip.IP, u.Hostname()); err != nil {
+			return "", err
+		}
+	}
+	if net.ParseIP(u.Hostname()) != nil {
+		return "", nil
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	ip := ips[0].IP.String()
+	if ips[0].IP.To4() == nil {
+		ip = "[" + ip + "]"
+	}
+	return fmt.Sprintf("%s:%s:%s", u.Hostname(), port, ip), nil
+}
+
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func checkIP(ip net.IP, host string) error {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || sharedAddressSpace.Contains(ip) {
+		return &PolicyError{fmt.Sprintf("%v resolves to private address %v", host, ip)}
+	}
+	return nil
+}
+
+// Refuse connections to private addresses, see net.Dialer.Control.
+func (p *UpstreamPolicy) control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return &PolicyError{fmt.Sprintf("cannot connect to %v", address)}
+	}
+	return checkIP(ip, host)
+}
+
+// A transport for talking to upstream under this policy.
+func (p *UpstreamPolicy) Transport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if !p.allowPrivate {
+		// Through an HTTP proxy, only the proxy's address could be checked
+		t.Proxy = nil
+		t.DialContext = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control:   p.control,
+		}).DialContext
+	}
+	return t
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUpstreamPolicyCheck(t *testing.T) {
+	p := NewUpstreamPolicy([]string{"github.com/...", "gitlab.com/acme/*"}, []string{"github.com/evil/*"}, true)
+
+	var tests = []struct {
+		repo string
+		err  string
+	}{
+		{"github.com/foo/bar", ""},
+		{"gitlab.com/acme/tools", ""},
+		{"gitlab.com/other/tools", "gitlab.com/other/tools is not allowed"},
+		{"github.com/evil/bar", "github.com/evil/bar is denied"},
+		{"github.com/foo/..", "github.com/foo/.. is not a valid repository path"},
+		{"github.com/foo/bar?x", "github.com/foo/bar?x is not a valid repository path"},
+		{"github.com/foo/", "github.com/foo/ is not a valid repository path"},
+	}
+
+	for _, tt := range tests {
+		err := p.Check(tt.repo, "https://"+tt.repo)
+		if tt.err == "" && err != nil {
+			t.Errorf("Check(%v): Expected no error, got %v", tt.repo, err)
+		} else if tt.err != "" {
+			if perr, ok := err.(*PolicyError); !ok || perr.Reason != tt.err {
+				t.Errorf("Check(%v): Expected '%v', got %v", tt.repo, tt.err, err)
+			}
+		}
+	}
+}
+
+func TestUpstreamPolicyPrivate(t *testing.T) {
+	p := NewUpstreamPolicy(nil, nil, false)
+
+	for _, url := range []string{"http://127.0.0.1:8080/foo/bar", "http://localhost/foo/bar", "http://[::1]/foo/bar"} {
+		if _, ok := p.Check("git.example.com/foo/bar", url).(*PolicyError); !ok {
+			t.Errorf("Expected %v to be refused", url)
+		}
+	}
+
+	var tests = []struct {
+		address string
+		ok      bool
+	}{
+		{"8.8.8.8:443", true},
+		{"[2001:4860:4860::8888]:443", true},
+		{"10.1.2.3:443", false},
+		{"172.16.0.1:443", false},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false},
+		{"100.64.0.1:80", false},
+		{"0.0.0.0:80", false},
+		{"[fd00::1]:443", false},
+		{"[fe80::1]:443", false},
+	}
+	for _, tt := range tests {
+		if err := p.control("tcp", tt.address, nil); (err == nil) != tt.ok {
+			t.Errorf("Connecting to %v: Expected ok=%v, got %v", tt.address, tt.ok, err)
+		}
+	}
+}
+
+func TestServeGitUpstreamPolicy(t *testing.T) {
+	p, upstream := newTestProxy(t, testAdvertisement)
+	defer upstream.Close()
+
+	c := *p.config
+	c.AllowPrivateNetworks = false
+	c.UpstreamDeny = []string{"git.example.com/secret/*"}
+	p, err := NewProxy(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		path   string
+		reason string
+	}{
+		{"/_git/git.example.com/foo/bar@master/info/refs?service=git-upload-pack", "resolves to private address 127.0.0.1"},
+		{"/_git/git.example.com/secret/bar/info/refs?service=git-upload-pack", "git.example.com/secret/bar is denied"},
+		{"/git.example.com/secret/bar@master", "git.example.com/secret/bar is denied"},
+		{"/git.example.com/secret/bar/@v/list", "git.example.com/secret/bar is denied"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		p.Handler().ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != 403 || !strings.Contains(w.Body.String(), tt.reason) {
+			t.Errorf("GET %v: Expected 403 '%v', got %v %q", tt.path, tt.reason, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestGitIgnoresUpstreamRedirects(t *testing.T) {
+	_, upstream, root := newTestGitUpstream(t)
+	defer os.RemoveAll(root)
+	defer upstream.Close()
+
+	// Could just as well point at 169.254.169.254
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, upstream.URL+r.URL.RequestURI(), 302)
+	}))
+	defer redirect.Close()
+
+	commit := runTestGit(t, filepath.Join(root, "foo", "bar"), "rev-parse", "master")
+	if l, err := fetchCommit(upstream.URL+"/foo/bar", commit, nil, nil); err != nil {
+		t.Fatalf("Expected fetching %v to work, got %v", commit, err)
+	} else {
+		l.Remove()
+	}
+	if l, err := fetchCommit(redirect.URL+"/foo/bar", commit, nil, nil); err == nil {
+		l.Remove()
+		t.Errorf("Expected git not to follow the redirect")
+	}
+	if l, err := fetchHistory(redirect.URL+"/foo/bar", nil, nil); err == nil {
+		l.Remove()
+		t.Errorf("Expected git not to follow the redirect")
+	}
+
+	// Nor connect to private addresses under the policy
+	policy := NewUpstreamPolicy(nil, nil, false)
+	if l, err := fetchCommit(upstream.URL+"/foo/bar", commit, nil, policy); err == nil {
+		l.Remove()
+		t.Errorf("Expected git not to connect to %v", upstream.URL)
+	} else if _, ok := err.(*PolicyError); !ok {
+		t.Errorf("Expected a PolicyError, got %v", err)
+	}
+}
+
+func TestServeGitUpstreamRedirects(t *testing.T) {
+	var hits int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte(testAdvertisement))
+	}))
+	defer target.Close()
+
+	p, upstream := newTestProxyWithUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+r.URL.RequestURI(), 302)
+	}))
+	defer upstream.Close()
+
+	c := *p.config
+	c.AuthPassthrough = true
+	p, err := NewProxy(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		"/_git/git.example.com/foo/bar@master/info/refs?service=git-upload-pack",
+		"/git.example.com/foo/bar/@v/list",
+	} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		p.Handler().ServeHTTP(w, r)
+		if w.Code != 403 || !strings.Contains(w.Body.String(), "upstream redirected to "+target.URL) {
+			t.Errorf("GET %v: Expected 403 for the redirect, got %v %q", path, w.Code, w.Body.String())
+		}
+	}
+	if hits != 0 {
+		t.Errorf("Expected the redirect not to be followed, got %v requests", hits)
+	}
+}
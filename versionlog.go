@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// What to do when a tag no longer points where it first did.
+const (
+	// Keep serving the commit the tag first resolved to.
+	VersionPolicyKeep = "keep"
+	// Refuse to serve the tag at all.
+	VersionPolicyRefuse = "refuse"
+)
+
+// Returned when a tag was moved upstream under VersionPolicyRefuse, or under
+// VersionPolicyKeep when no upstream ref points at the recorded commit any
+// more, so clients could not fetch it.
+type TagMovedError struct {
+	Ref      string
+	Recorded string
+	Current  string
+}
+
+func (e *TagMovedError) Error() string {
+	return fmt.Sprintf(
+		"Tag moved: %v was %v when first seen, now %v",
+		strings.TrimPrefix(e.Ref, "refs/tags/"), e.Recorded, e.Current,
+	)
+}
+
+// An append-only log of the commit each tag of each repository first
+// resolved to, so force-pushed tags cannot change what a version means. Each
+// line of the file is "<repo URL> <ref> <commit>".
+type VersionLog struct {
+	path   string
+	policy string
+
+	mu      sync.Mutex
+	commits map[string]string
+}
+
+func OpenVersionLog(path, policy string) (*VersionLog, error) {
+	l := &VersionLog{path: path, policy: policy, commits: make(map[string]string)}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("VersionLog: %v:%v: Expected '<repo> <ref> <commit>'", path, line)
+		}
+		// The first entry wins, should the file ever have duplicates
+		key := fields[0] + " " + fields[1]
+		if _, ok := l.commits[key]; !ok {
+			l.commits[key] = fields[2]
+		}
+	}
+	return l, s.Err()
+}
+
+// Check the commit a tag of a repository resolved to against the log. The
+// first time a tag is seen, its commit is recorded and returned. After that,
+// the recorded commit is returned, or a TagMovedError if it differs and the
+// policy is to refuse.
+func (l *VersionLog) Check(repoUrl, ref, commit string) (string, error) {
+	key := repoUrl + " " + ref
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if recorded, ok := l.commits[key]; ok {
+		if recorded != commit && l.policy == VersionPolicyRefuse {
+			return "", &TagMovedError{Ref: ref, Recorded: recorded, Current: commit}
+		}
+		return recorded, nil
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fmt.Fprintf(f, "%s %s\n", key, commit); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	l.commits[key] = commit
+	return commit, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVersionLogCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gvp-versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "versions.log")
+
+	l, err := OpenVersionLog(path, VersionPolicyKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit, err := l.Check("https://example.com/foo", "refs/tags/v1", "aaaa"); err != nil || commit != "aaaa" {
+		t.Errorf("First check: Expected aaaa, got %v, %v", commit, err)
+	}
+	if commit, err := l.Check("https://example.com/foo", "refs/tags/v1", "bbbb"); err != nil || commit != "aaaa" {
+		t.Errorf("Moved tag: Expected aaaa, got %v, %v", commit, err)
+	}
+	if commit, err := l.Check("https://example.com/bar", "refs/tags/v1", "bbbb"); err != nil || commit != "bbbb" {
+		t.Errorf("Other repo: Expected bbbb, got %v, %v", commit, err)
+	}
+
+	// The log survives a restart
+	l, err = OpenVersionLog(path, VersionPolicyRefuse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit, err := l.Check("https://example.com/foo", "refs/tags/v1", "aaaa"); err != nil || commit != "aaaa" {
+		t.Errorf("Reopened: Expected aaaa, got %v, %v", commit, err)
+	}
+	_, err = l.Check("https://example.com/foo", "refs/tags/v1", "cccc")
+	if moved, ok := err.(*TagMovedError); !ok || moved.Recorded != "aaaa" || moved.Current != "cccc" {
+		t.Errorf("Refused: Expected TagMovedError from aaaa to cccc, got %v", err)
+	}
+}
+
+func TestServeGitMovedTag(t *testing.T) {
+	p, upstream, root := newTestGitUpstream(t)
+	defer os.RemoveAll(root)
+	defer upstream.Close()
+
+	bare := filepath.Join(root, "foo", "bar")
+	original := runTestGit(t, bare, "rev-parse", "v1.0.0")
+	tip := runTestGit(t, bare, "rev-parse", "master")
+
+	path := "/_git/git.example.com/foo/bar@v1.0.0/info/refs?service=git-upload-pack"
+	get := func(p *Proxy) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.Handler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	c := *p.config
+	c.VersionLog = filepath.Join(root, "versions.log")
+	keep, err := NewProxy(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := get(keep); w.Code != 200 || !strings.Contains(w.Body.String(), original+" HEAD") {
+		t.Fatalf("Expected HEAD at %v, got %v %q", original, w.Code, w.Body.String())
+	}
+
+	runTestGit(t, bare, "branch", "old", "v1.0.0")
+	runTestGit(t, bare, "tag", "-f", "v1.0.0", "master")
+
+	// Still the commit first seen, which clients can fetch as a branch has it
+	if w := get(keep); w.Code != 200 || !strings.Contains(w.Body.String(), original+" HEAD") {
+		t.Errorf("Keep: Expected HEAD at %v, got %v %q", original, w.Code, w.Body.String())
+	}
+	proxy := httptest.NewServer(keep.Handler())
+	defer proxy.Close()
+	for _, version := range []string{"0", "2"} {
+		dest := filepath.Join(root, "clone-v"+version)
+		runTestGit(t, root, "-c", "protocol.version="+version, "clone", "--quiet", proxy.URL+"/_git/git.example.com/foo/bar@v1.0.0", dest)
+		if got := runTestGit(t, dest, "rev-parse", "HEAD"); got != original {
+			t.Errorf("Keep, protocol v%v: Expected a clone at %v, got %v", version, original, got)
+		}
+	}
+
+	// Nothing upstream has it any more, so it cannot be kept
+	runTestGit(t, bare, "branch", "-D", "old")
+	if w := get(keep); w.Code != 404 || !strings.Contains(w.Body.String(), "Tag moved: v1.0.0 was "+original+" when first seen, now "+tip) {
+		t.Errorf("Keep: Expected tag moved error once the commit is gone, got %v %q", w.Code, w.Body.String())
+	}
+
+	// Or an error
+	c.VersionPolicy = VersionPolicyRefuse
+	refuse, err := NewProxy(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := get(refuse)
+	if w.Code != 404 || !strings.Contains(w.Body.String(), "Tag moved: v1.0.0 was "+original+" when first seen, now "+tip) {
+		t.Errorf("Refuse: Expected tag moved error, got %v %q", w.Code, w.Body.String())
+	}
+}
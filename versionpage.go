@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A tag or branch as listed on the version page.
+type pageVersion struct {
+	Name   string
+	Ref    string
+	Commit string
+	// What to put after the @ in go get, ex. "v1.2.3".
+	GoGet string
+	// Whether the requested version resolved to this ref.
+	Resolved bool
+}
+
+type versionPage struct {
+	Root     string
+	Upstream string
+	// The requested version, what it resolved to or why it did not.
+	Commitish string
+	Ref       string
+	Commit    string
+	Error     string
+	Tags      []*pageVersion
+	Branches  []*pageVersion
+}
+
+var versionPageTemplate = template.Must(template.New("versions").Parse(`<!DOCTYPE html>
+<html><head>
+<meta charset="utf-8">
+<title>{{.Root}}</title>
+</head><body>
+<h1>{{.Root}}</h1>
+<p>Upstream: <a href="{{.Upstream}}">{{.Upstream}}</a></p>
+{{if .Error}}<p><strong>{{.Commitish}}</strong>: {{.Error}}</p>
+{{else if .Commitish}}<p><strong>{{.Commitish}}</strong> resolves to {{if .Ref}}{{.Ref}} at {{end}}<code>{{.Commit}}</code></p>
+{{end}}
+{{- define "list"}}<table>
+{{range .}}<tr><td>{{if .Resolved}}<strong>{{.Name}}</strong>{{else}}{{.Name}}{{end}}</td><td><code>{{.Commit}}</code></td><td><code>{{.GoGet}}</code></td></tr>
+{{end}}</table>
+{{end -}}
+<h2>Tags</h2>
+{{template "list" .Tags}}<h2>Branches</h2>
+{{template "list" .Branches}}</body></html>
+`))
+
+// Serve a page listing the tags and branches of a repository, and what the
+// requested version, if any, resolves to.
+func (p *Proxy) serveVersions(w http.ResponseWriter, r *http.Request, ip *ImportPath) {
+	repoUrl := ip.Host.RepoURL(ip.Repo)
+	adv, err := p.advertisement(repoUrl, r.Header)
+	if err != nil {
+		log.Printf("Versions: Cannot list %v: %v", ip.Root(), err)
+		http.Error(w, fmt.Sprintf("%v: %v", ip.Root(), err), errorStatus(err))
+		return
+	}
+
+	page := &versionPage{
+		Root:      ip.Root(),
+		Upstream:  strings.TrimSuffix(repoUrl, ".git"),
+		Commitish: ip.Commitish,
+	}
+	if ip.Commitish != "" {
+		page.Ref, _, err = adv.findRef(ip.Commitish)
+	}
+	// Listed before pinning moves the default branch
+	page.Tags, page.Branches = p.pageVersions(adv, ip, page.Ref)
+
+	status := 200
+	if ip.Commitish != "" {
+		// Pinning goes by the version log, like go get would
+		if err == nil {
+			err = p.pin(adv, repoUrl, ip.Commitish)
+		}
+		if errors.Is(err, ErrCommitishNotFound) {
+			page.Error = "not found"
+			status = 404
+		} else if err != nil {
+			page.Error = err.Error()
+			status = errorStatus(err)
+		} else {
+			page.Commit = adv.refs["HEAD"]
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := versionPageTemplate.Execute(w, page); err != nil {
+		log.Printf("Versions: Cannot write the page for %v: %v", ip.Root(), err)
+	}
+}
+
+// The tags, newest version first, and branches of an advertisement.
+func (p *Proxy) pageVersions(adv *GitUploadPack, ip *ImportPath, resolved string) ([]*pageVersion, []*pageVersion) {
+	var tags, branches []*pageVersion
+	for ref := range adv.refs {
+		var name string
+		var list *[]*pageVersion
+		if strings.HasPrefix(ref, "refs/tags/") {
+			name, list = strings.TrimPrefix(ref, "refs/tags/"), &tags
+		} else if strings.HasPrefix(ref, "refs/heads/") {
+			name, list = strings.TrimPrefix(ref, "refs/heads/"), &branches
+		} else {
+			continue
+		}
+
+		// "@a/b" would be taken for a path, so such refs go by commit
+		version := name
+		if strings.Contains(name, "/") {
+			version = adv.peeled(ref)
+		}
+		*list = append(*list, &pageVersion{
+			Name:     name,
+			Ref:      ref,
+			Commit:   adv.peeled(ref),
+			GoGet:    fmt.Sprintf("go get %s/%s@%s", p.config.Host, ip.Root(), version),
+			Resolved: ref == resolved,
+		})
+	}
+
+	// Versions by precedence, then anything else by name
+	sort.Slice(tags, func(i, j int) bool {
+		a, aErr := ParseVersion(tags[i].Name)
+		b, bErr := ParseVersion(tags[j].Name)
+		switch {
+		case aErr == nil && bErr == nil && a.Compare(b) != 0:
+			return a.Compare(b) > 0
+		case (aErr == nil) != (bErr == nil):
+			return aErr == nil
+		}
+		return tags[i].Name < tags[j].Name
+	})
+	sort.Slice(branches, func(i, j int) bool { return branches[i].Name < branches[j].Name })
+	return tags, branches
+}
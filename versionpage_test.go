@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var testTagsAdvertisement = "001e# service=git-upload-pack\n0000" +
+	writePktLine("c7d3d3371baa35587fb66d8a79c6d999a4dafd8e HEAD\000multi_ack side-band-64k ofs-delta\n") +
+	writePktLine("1111111111111111111111111111111111111111 refs/heads/feature/x\n") +
+	writePktLine("c7d3d3371baa35587fb66d8a79c6d999a4dafd8e refs/heads/master\n") +
+	writePktLine("2222222222222222222222222222222222222222 refs/tags/nightly\n") +
+	writePktLine("3333333333333333333333333333333333333333 refs/tags/v1.0.0\n") +
+	writePktLine("4444444444444444444444444444444444444444 refs/tags/v1.10.0\n") +
+	writePktLine("5555555555555555555555555555555555555555 refs/tags/v1.2.0\n") +
+	writePktLine("48da4910b78e24d8d3a831839cc751700ddc6e10 refs/tags/v1.2.0^{}\n") +
+	"0000"
+
+func TestServeVersions(t *testing.T) {
+	p, upstream := newTestProxy(t, testTagsAdvertisement)
+	defer upstream.Close()
+	p.config.Host = "go.example.com"
+
+	w := httptest.NewRecorder()
+	p.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/git.example.com/foo/bar@v1.2/sub", nil))
+	body := w.Body.String()
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %v %q", w.Code, body)
+	}
+
+	// Tags newest first, then anything not a version
+	names := regexp.MustCompile(`<tr><td>(?:<strong>)?([^<]+)`).FindAllStringSubmatch(body, -1)
+	got := []string{}
+	for _, m := range names {
+		got = append(got, m[1])
+	}
+	if exp := "v1.10.0 v1.2.0 v1.0.0 nightly feature/x master"; strings.Join(got, " ") != exp {
+		t.Errorf("Expected versions %v, got %v", exp, got)
+	}
+
+	for _, exp := range []string{
+		"<strong>v1.2</strong> resolves to refs/tags/v1.2.0 at <code>48da4910b78e24d8d3a831839cc751700ddc6e10</code>",
+		"<tr><td><strong>v1.2.0</strong></td><td><code>48da4910b78e24d8d3a831839cc751700ddc6e10</code>",
+		"go get go.example.com/git.example.com/foo/bar@v1.10.0",
+		"go get go.example.com/git.example.com/foo/bar@1111111111111111111111111111111111111111",
+	} {
+		if !strings.Contains(body, exp) {
+			t.Errorf("Expected page to contain %q, got %q", exp, body)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	p.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/git.example.com/foo/bar@v9", nil))
+	if w.Code != 404 || !strings.Contains(w.Body.String(), "<strong>v9</strong>: not found") {
+		t.Errorf("Expected v9 not to be found, got %v %q", w.Code, w.Body.String())
+	}
+}